@@ -0,0 +1,45 @@
+package controllers
+
+import (
+	"captureorderfd/models"
+	"time"
+
+	"github.com/astaxie/beego"
+)
+
+// Operations for the people running the service
+type AdminController struct {
+	beego.Controller
+}
+
+// @Title Stuck Outbox Events
+// @Description List order events that are still waiting to be published to AMQP
+// @Param	Authorization	header	string	true	"shared access signature signed with an admin key, for https://<host>/v1/admin"
+// @Param	olderThan	query	string	false	"Go duration such as 30s or 5m, defaults to OUTBOX_STUCK_AFTER"
+// @Success 200 {object} models.StuckEvents
+// @Failure 400 olderThan is malformed
+// @Failure 401 the shared access signature is missing, invalid or expired
+// @Failure 403 the admin API is disabled, no admin key is configured
+// @router /outbox [get]
+func (this *AdminController) Outbox() {
+	var olderThan time.Duration
+	if value := this.GetString("olderThan"); value != "" {
+		var err error
+		if olderThan, err = time.ParseDuration(value); err != nil || olderThan <= 0 {
+			this.Data["json"] = map[string]string{"error": "olderThan must be a positive duration such as 30s or 5m"}
+			this.Ctx.Output.SetStatus(400)
+			this.ServeJSON()
+			return
+		}
+	}
+
+	events, err := models.StuckOutboxEvents(olderThan)
+	if err == nil {
+		this.Data["json"] = models.StuckEvents{Entries: events, Count: len(events)}
+	} else {
+		this.Data["json"] = map[string]string{"error": "outbox could not be read from the order store. Check logs: " + err.Error()}
+		this.Ctx.Output.SetStatus(500)
+	}
+
+	this.ServeJSON()
+}
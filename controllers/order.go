@@ -1,8 +1,10 @@
 package controllers
 
 import (
+	"bytes"
 	"captureorderfd/models"
 	"encoding/json"
+	"time"
 
 	"github.com/astaxie/beego"
 )
@@ -13,30 +15,274 @@ type OrderController struct {
 }
 
 // @Title Capture Order
-// @Description Capture order POST
+// @Description Capture order POST. Send an Idempotency-Key header to safely retry the request.
+// @Param	Idempotency-Key	header	string	false	"unique key for this order, retries with the same key return the original orderId"
+// @Param	X-Request-ID	header	string	false	"id of the request in the logs, telemetry and events, one is generated if missing"
+// @Param	X-Correlation-ID	header	string	false	"passed on to the OrderCreated event"
+// @Param	traceparent	header	string	false	"W3C trace context, the order is traced as part of this trace"
 // @Param	body	body 	models.Order true		"body for order content"
 // @Success 200 {string} models.Order.ID
-// @Failure 403 body is empty
+// @Failure 400 {object} models.ValidationError body is empty or invalid
+// @Failure 409 a request with the same Idempotency-Key is still in progress
+// @Failure 422 the Idempotency-Key was already used with a different body
 // @router / [post]
 func (this *OrderController) Post() {
+	models.CountOrderReceived()
+	ctx, span := models.StartRequestSpan(this.Ctx.Request, "POST /v1/order")
+	defer func() { models.EndRequestSpan(span, this.Ctx.ResponseWriter.Status) }()
 
 	var ob models.Order
-	json.Unmarshal(this.Ctx.Input.RequestBody, &ob)
+	if !this.decodeAndValidate(&ob) {
+		return
+	}
 
-	models.TrackInitialOrder(ob)
-	// Add the order to MongoDB
-	addedOrder, err := models.AddOrderToMongoDB(ob)
+	// Replay the original response if this order was already captured
+	var claim models.IdempotencyRecord
+	idempotencyKey := this.Ctx.Input.Header("Idempotency-Key")
+	if idempotencyKey != "" {
+		var replayed bool
+		var err error
+		claim, replayed, err = models.ClaimIdempotencyKey(ctx, idempotencyKey, this.Ctx.Input.RequestBody)
+		switch err {
+		case nil:
+		case models.ErrInvalidIdempotencyKey:
+			models.CountValidationFailure(models.ValidationIdempotencyKey)
+			this.badRequest("Idempotency-Key must be at most 255 characters")
+			return
+		case models.ErrIdempotencyKeyInProgress:
+			this.Data["json"] = map[string]string{"error": "a request with this Idempotency-Key is still in progress"}
+			this.Ctx.Output.SetStatus(409)
+			this.ServeJSON()
+			return
+		case models.ErrIdempotencyKeyReused:
+			this.Data["json"] = map[string]string{"error": "this Idempotency-Key was already used with a different body"}
+			this.Ctx.Output.SetStatus(422)
+			this.ServeJSON()
+			return
+		default:
+			this.Data["json"] = map[string]string{"error": "Idempotency-Key could not be checked in the order store. Check logs: " + err.Error()}
+			this.Ctx.Output.SetStatus(500)
+			this.ServeJSON()
+			return
+		}
 
-	if err == nil {
-		// Add the order to AMQP
-		models.AddOrderToAMQP(addedOrder)
+		if replayed {
+			this.Ctx.Output.Header("Idempotent-Replayed", "true")
+			this.Data["json"] = map[string]string{"orderId": claim.OrderID}
+			this.ServeJSON()
+			return
+		}
+	}
+
+	models.TrackInitialOrder(ctx, ob)
+	// Add the order to the order store, under the id claimed with the Idempotency-Key if any
+	var addedOrder models.Order
+	var replayed bool
+	var err error
+	if idempotencyKey != "" {
+		addedOrder, replayed, err = models.AddIdempotentOrder(ctx, claim, ob, this.Ctx.Input.Header("X-Correlation-ID"))
+	} else {
+		addedOrder, err = models.AddOrder(ctx, ob, this.Ctx.Input.Header("X-Correlation-ID"))
+	}
+
+	if err == nil && idempotencyKey != "" {
+		// A retry with the same key finds the order and replays it once the lease runs out
+		if err = models.CompleteIdempotencyKey(ctx, idempotencyKey, addedOrder.OrderID); err != nil {
+			this.Data["json"] = map[string]string{"error": "order added but its Idempotency-Key could not be recorded, retry with the same key. Check logs: " + err.Error()}
+			this.Ctx.Output.SetStatus(500)
+			this.ServeJSON()
+			return
+		}
+	}
 
-		// return
+	if err == nil {
+		// The order is published to AMQP by the outbox relay
+		if replayed {
+			this.Ctx.Output.Header("Idempotent-Replayed", "true")
+		}
 		this.Data["json"] = map[string]string{"orderId": addedOrder.OrderID}
 	} else {
-		this.Data["json"] = map[string]string{"error": "order not added to MongoDB. Check logs: " + err.Error()}
+		if idempotencyKey != "" {
+			models.ReleaseIdempotencyKey(ctx, claim)
+		}
+
+		this.Data["json"] = map[string]string{"error": "order not added to the order store. Check logs: " + err.Error()}
+		this.Ctx.Output.SetStatus(500)
+	}
+
+	this.ServeJSON()
+}
+
+// @Title Get Order
+// @Description Get order by id
+// @Param	orderId	path 	string	true		"the hex ObjectId of the order"
+// @Success 200 {object} models.Order
+// @Failure 400 orderId is malformed
+// @Failure 404 order not found
+// @router /:orderId [get]
+func (this *OrderController) Get() {
+	orderID := this.Ctx.Input.Param(":orderId")
+
+	order, err := models.GetOrder(this.Ctx.Request.Context(), orderID)
+
+	switch err {
+	case nil:
+		this.Data["json"] = order
+	case models.ErrInvalidOrderID:
+		this.badRequest("orderId must be a 24 character hex ObjectId")
+		return
+	case models.ErrOrderNotFound:
+		this.Data["json"] = map[string]string{"error": "order " + orderID + " not found"}
+		this.Ctx.Output.SetStatus(404)
+	default:
+		this.Data["json"] = map[string]string{"error": "order could not be read from the order store. Check logs: " + err.Error()}
+		this.Ctx.Output.SetStatus(500)
+	}
+
+	this.ServeJSON()
+}
+
+// @Title List Orders
+// @Description List orders, oldest first, one page at a time
+// @Param	cursor	query	string	false	"nextCursor returned with the previous page"
+// @Param	limit	query	int	false	"page size, defaults to 20, at most 100"
+// @Param	email	query	string	false	"filter on EmailAddress"
+// @Param	status	query	string	false	"filter on Status"
+// @Param	product	query	string	false	"filter on Product"
+// @Param	source	query	string	false	"filter on Source"
+// @Param	partition	query	string	false	"filter on Partition"
+// @Param	createdFrom	query	string	false	"RFC 3339 time, only orders created at or after it"
+// @Param	createdTo	query	string	false	"RFC 3339 time, only orders created before it"
+// @Success 200 {object} models.OrderPage
+// @Failure 400 a query parameter is malformed
+// @router / [get]
+func (this *OrderController) GetAll() {
+	filter := models.OrderFilter{
+		EmailAddress: this.GetString("email"),
+		Status:       this.GetString("status"),
+		Product:      this.GetString("product"),
+		Source:       this.GetString("source"),
+		Partition:    this.GetString("partition"),
+	}
+
+	limit, err := this.GetInt("limit", models.DefaultOrderPageSize)
+	if err != nil || limit <= 0 {
+		this.badRequest("limit must be a positive integer")
+		return
+	}
+
+	if filter.CreatedFrom, err = this.getTime("createdFrom"); err != nil {
+		this.badRequest("createdFrom must be an RFC 3339 time")
+		return
+	}
+	if filter.CreatedTo, err = this.getTime("createdTo"); err != nil {
+		this.badRequest("createdTo must be an RFC 3339 time")
+		return
+	}
+
+	page, err := models.ListOrders(this.Ctx.Request.Context(), filter, this.GetString("cursor"), limit)
+
+	switch err {
+	case nil:
+		this.Data["json"] = page
+	case models.ErrInvalidCursor:
+		this.badRequest("cursor is not valid")
+		return
+	default:
+		this.Data["json"] = map[string]string{"error": "orders could not be read from the order store. Check logs: " + err.Error()}
+		this.Ctx.Output.SetStatus(500)
+	}
+
+	this.ServeJSON()
+}
+
+// @Title Update Order Status
+// @Description Move an order to a new status. Open -> Confirmed -> Fulfilled -> Refunded, Open and Confirmed orders can also be Cancelled.
+// @Param	orderId	path 	string	true		"the hex ObjectId of the order"
+// @Param	body	body 	models.StatusChange	true		"the new status"
+// @Param	X-Correlation-ID	header	string	false	"passed on to the OrderStatusChanged event"
+// @Success 200 {object} models.Order
+// @Failure 400 {object} models.ValidationError orderId, body or status is malformed
+// @Failure 404 order not found
+// @Failure 409 the order can't move from its current status to the requested one
+// @router /:orderId/status [put,patch]
+func (this *OrderController) UpdateStatus() {
+	orderID := this.Ctx.Input.Param(":orderId")
+
+	var change models.StatusChange
+	if !this.decodeAndValidate(&change) {
+		return
+	}
+
+	// The status change is published to AMQP by the outbox relay
+	order, _, err := models.UpdateOrderStatus(this.Ctx.Request.Context(), orderID, change.Status, change.Reason, this.Ctx.Input.Header("X-Correlation-ID"))
+
+	switch err {
+	case nil:
+		this.Data["json"] = order
+	case models.ErrInvalidOrderID:
+		this.badRequest("orderId must be a 24 character hex ObjectId")
+		return
+	case models.ErrInvalidStatus:
+		this.badRequest("status " + change.Status + " is not a valid order status")
+		return
+	case models.ErrOrderNotFound:
+		this.Data["json"] = map[string]string{"error": "order " + orderID + " not found"}
+		this.Ctx.Output.SetStatus(404)
+	case models.ErrInvalidTransition:
+		this.Data["json"] = map[string]string{"error": "order " + orderID + " can't move from " + order.Status + " to " + change.Status}
+		this.Ctx.Output.SetStatus(409)
+	default:
+		this.Data["json"] = map[string]string{"error": "order status not updated in the order store. Check logs: " + err.Error()}
 		this.Ctx.Output.SetStatus(500)
 	}
 
 	this.ServeJSON()
 }
+
+// getTime parses an optional RFC 3339 query parameter
+func (this *OrderController) getTime(key string) (time.Time, error) {
+	value := this.GetString(key)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// decodeAndValidate unmarshals the JSON request body into v and validates it.
+// It serves a 400 and returns false if the body is empty, malformed or invalid.
+func (this *OrderController) decodeAndValidate(v interface{}) bool {
+	body := this.Ctx.Input.RequestBody
+	if len(bytes.TrimSpace(body)) == 0 {
+		models.CountValidationFailure(models.ValidationEmpty)
+		this.badRequest("body is empty")
+		return false
+	}
+
+	if err := json.Unmarshal(body, v); err != nil {
+		models.CountValidationFailure(models.ValidationJSON)
+		this.badRequest("body is not valid JSON: " + err.Error())
+		return false
+	}
+
+	if err := models.Validate(v); err != nil {
+		models.CountValidationFailure(models.ValidationInvalid)
+		if validationErr, ok := err.(*models.ValidationError); ok {
+			this.Data["json"] = map[string]interface{}{"error": "body is invalid", "fields": validationErr.Fields}
+		} else {
+			this.Data["json"] = map[string]string{"error": err.Error()}
+		}
+		this.Ctx.Output.SetStatus(400)
+		this.ServeJSON()
+		return false
+	}
+
+	return true
+}
+
+// badRequest serves a 400 with the given error message
+func (this *OrderController) badRequest(message string) {
+	this.Data["json"] = map[string]string{"error": message}
+	this.Ctx.Output.SetStatus(400)
+	this.ServeJSON()
+}
@@ -0,0 +1,263 @@
+package controllers
+
+import (
+	"captureorderfd/models"
+	stdcontext "context"
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/astaxie/beego/context"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// newTestController returns an OrderController serving a request with the given body
+func newTestController(body string) (*OrderController, *httptest.ResponseRecorder) {
+	return newTestRequest("POST", "/v1/order", "", body)
+}
+
+// newTestRequest returns an OrderController serving a request to target for the order orderID, if any, with the given body
+func newTestRequest(method string, target string, orderID string, body string) (*OrderController, *httptest.ResponseRecorder) {
+	recorder := httptest.NewRecorder()
+	ctx := context.NewContext()
+	ctx.Reset(recorder, httptest.NewRequest(method, target, nil))
+	ctx.Input.RequestBody = []byte(body)
+	if orderID != "" {
+		ctx.Input.SetParam(":orderId", orderID)
+	}
+
+	controller := &OrderController{}
+	controller.Init(ctx, "OrderController", "Post", controller)
+	return controller, recorder
+}
+
+func TestDecodeAndValidate(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		body     string
+		expected map[string]interface{}
+	}{
+		{"empty", "  ", map[string]interface{}{"error": "body is empty"}},
+		{"invalid", `{"EmailAddress": "test@localhost", "PreferredLanguage": "en_US", "Total": -1}`, map[string]interface{}{
+			"error": "body is invalid",
+			"fields": []interface{}{
+				map[string]interface{}{"field": "EmailAddress", "message": "must be a valid email address"},
+				map[string]interface{}{"field": "PreferredLanguage", "message": "must be a BCP 47 language tag such as en or en-US"},
+				map[string]interface{}{"field": "Total", "message": "must be at least 0"},
+			},
+		}},
+	} {
+		controller, recorder := newTestController(test.body)
+		var order models.Order
+		if controller.decodeAndValidate(&order) {
+			t.Errorf("%s: the body was accepted", test.name)
+			continue
+		}
+
+		var body map[string]interface{}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%s: the response %q is not JSON: %v", test.name, recorder.Body.String(), err)
+		}
+		if recorder.Code != 400 || !reflect.DeepEqual(body, test.expected) {
+			t.Errorf("%s: served %d %v, expected 400 %v", test.name, recorder.Code, body, test.expected)
+		}
+	}
+
+	controller, recorder := newTestController(`{"EmailAddress": "test@domain.com"`)
+	if controller.decodeAndValidate(&models.Order{}) || recorder.Code != 400 {
+		t.Errorf("Malformed JSON was accepted")
+	}
+
+	controller, _ = newTestController(`{"EmailAddress": "test@domain.com", "PreferredLanguage": "en-US"}`)
+	var order models.Order
+	if !controller.decodeAndValidate(&order) || order.EmailAddress != "test@domain.com" {
+		t.Errorf("A valid body was rejected or not decoded: %+v", order)
+	}
+}
+
+// useMemoryStore has the controllers store orders in memory, and captures one
+func useMemoryStore(t *testing.T) models.Order {
+	if err := models.UseStore(models.StoreMemory); err != nil {
+		t.Fatalf("UseStore returned %v", err)
+	}
+	order, err := models.AddOrder(stdcontext.Background(), models.Order{EmailAddress: "test@domain.com", Product: "Widget"}, "")
+	if err != nil {
+		t.Fatalf("AddOrder returned %v", err)
+	}
+	return order
+}
+
+func TestUpdateStatus(t *testing.T) {
+	order := useMemoryStore(t)
+
+	for _, test := range []struct {
+		name     string
+		body     string
+		code     int
+		expected string
+	}{
+		{"confirmed", `{"Status": "Confirmed"}`, 200, models.StatusConfirmed},
+		{"reopened", `{"Status": "Open"}`, 409, "order " + order.OrderID + " can't move from Confirmed to Open"},
+		{"refunded before fulfilled", `{"Status": "Refunded", "Reason": "Broken"}`, 409, "order " + order.OrderID + " can't move from Confirmed to Refunded"},
+		{"unknown", `{"Status": "Lost"}`, 400, "status Lost is not a valid order status"},
+		{"fulfilled", `{"Status": "Fulfilled"}`, 200, models.StatusFulfilled},
+		{"cancelled after fulfilled", `{"Status": "Cancelled"}`, 409, "order " + order.OrderID + " can't move from Fulfilled to Cancelled"},
+	} {
+		controller, recorder := newTestRequest("PUT", "/v1/order/"+order.OrderID+"/status", order.OrderID, test.body)
+		controller.UpdateStatus()
+
+		var body map[string]interface{}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%s: the response %q is not JSON: %v", test.name, recorder.Body.String(), err)
+		}
+		got := body["error"]
+		if test.code == 200 {
+			got = body["Status"]
+		}
+		if recorder.Code != test.code || got != test.expected {
+			t.Errorf("%s: served %d %v, expected %d %s", test.name, recorder.Code, body, test.code, test.expected)
+		}
+	}
+
+	// Only the legal transitions are in the audit trail
+	stored, _ := models.GetOrder(stdcontext.Background(), order.OrderID)
+	if len(stored.StatusHistory) != 3 || stored.Status != models.StatusFulfilled {
+		t.Errorf("The order is %s with the audit trail %+v, expected Fulfilled after Open and Confirmed", stored.Status, stored.StatusHistory)
+	}
+}
+
+func TestGet(t *testing.T) {
+	order := useMemoryStore(t)
+
+	for _, test := range []struct {
+		name     string
+		orderID  string
+		code     int
+		expected string
+	}{
+		{"captured", order.OrderID, 200, order.OrderID},
+		{"malformed", "not-an-id", 400, "orderId must be a 24 character hex ObjectId"},
+		{"missing", "5b0bc3a4c0e0e27d4c2b0f6e", 404, "order 5b0bc3a4c0e0e27d4c2b0f6e not found"},
+	} {
+		controller, recorder := newTestRequest("GET", "/v1/order/"+test.orderID, test.orderID, "")
+		controller.Get()
+
+		var body map[string]interface{}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%s: the response %q is not JSON: %v", test.name, recorder.Body.String(), err)
+		}
+		got := body["error"]
+		if test.code == 200 {
+			got = body["OrderID"]
+		}
+		if recorder.Code != test.code || got != test.expected {
+			t.Errorf("%s: served %d %v, expected %d %s", test.name, recorder.Code, body, test.code, test.expected)
+		}
+	}
+}
+
+func TestGetAll(t *testing.T) {
+	if err := models.UseStore(models.StoreMemory); err != nil {
+		t.Fatalf("UseStore returned %v", err)
+	}
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	var ids []string
+	for i, product := range []string{"Widget", "Gadget", "Widget", "Gadget", "Widget"} {
+		id := bson.NewObjectIdWithTime(start.Add(time.Duration(i) * time.Hour)).Hex()
+		email := "test@domain.com"
+		if i == 4 {
+			email = "other@domain.com"
+		}
+		if _, err := models.AddOrderWithID(stdcontext.Background(), id, models.Order{EmailAddress: email, Product: product}, ""); err != nil {
+			t.Fatalf("AddOrderWithID returned %v", err)
+		}
+		ids = append(ids, id)
+	}
+
+	list := func(query string) (int, models.OrderPage, string) {
+		controller, recorder := newTestRequest("GET", "/v1/order?"+query, "", "")
+		controller.GetAll()
+
+		var page models.OrderPage
+		if recorder.Code != 200 {
+			return recorder.Code, page, recorder.Body.String()
+		}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &page); err != nil {
+			t.Fatalf("%s: the response %q is not a page: %v", query, recorder.Body.String(), err)
+		}
+		return recorder.Code, page, ""
+	}
+
+	// Two at a time, oldest first, until there is no next page
+	var seen []string
+	for query, pages := "limit=2", 0; ; pages++ {
+		if pages == 3 {
+			t.Fatalf("More than 3 pages of 2 for 5 orders, seen %v", seen)
+		}
+		code, page, body := list(query)
+		if code != 200 {
+			t.Fatalf("%s: served %d %s", query, code, body)
+		}
+		if page.Count != len(page.Orders) || page.Count > 2 {
+			t.Errorf("%s: %d orders with count %d", query, len(page.Orders), page.Count)
+		}
+		for _, order := range page.Orders {
+			seen = append(seen, order.OrderID)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		query = "limit=2&cursor=" + page.NextCursor
+	}
+	if !reflect.DeepEqual(seen, ids) {
+		t.Errorf("Paging returned %v, expected %v", seen, ids)
+	}
+
+	for _, test := range []struct {
+		query    string
+		expected []string
+	}{
+		{"", ids},
+		{"product=Widget", []string{ids[0], ids[2], ids[4]}},
+		{"product=Widget&email=test@domain.com", []string{ids[0], ids[2]}},
+		{"email=other@domain.com", []string{ids[4]}},
+		{"status=Open&source=nowhere", nil},
+		{"createdFrom=2020-01-01T01:00:00Z", ids[1:]},
+		{"createdTo=2020-01-01T01:00:00Z", ids[:1]},
+		{"createdFrom=2020-01-01T01:00:00Z&createdTo=2020-01-01T03:00:00Z", ids[1:3]},
+		{"createdFrom=2020-01-01T02:00:00%2B01:00&createdTo=2020-01-01T03:30:00Z", ids[1:4]},
+		{"product=Gadget&createdFrom=2020-01-01T02:00:00Z", ids[3:4]},
+	} {
+		code, page, body := list(test.query)
+		if code != 200 {
+			t.Errorf("%q: served %d %s", test.query, code, body)
+			continue
+		}
+		var got []string
+		for _, order := range page.Orders {
+			got = append(got, order.OrderID)
+		}
+		if !reflect.DeepEqual(got, test.expected) || page.NextCursor != "" {
+			t.Errorf("%q: listed %v, next cursor %q, expected %v", test.query, got, page.NextCursor, test.expected)
+		}
+	}
+
+	for _, test := range []struct {
+		query    string
+		expected string
+	}{
+		{"limit=0", "limit must be a positive integer"},
+		{"limit=ten", "limit must be a positive integer"},
+		{"createdFrom=yesterday", "createdFrom must be an RFC 3339 time"},
+		{"createdTo=2020-01-01", "createdTo must be an RFC 3339 time"},
+		{"cursor=not-a-cursor", "cursor is not valid"},
+	} {
+		code, _, body := list(test.query)
+		if code != 400 || !strings.Contains(body, test.expected) {
+			t.Errorf("%q: served %d %s, expected 400 %q", test.query, code, body, test.expected)
+		}
+	}
+}
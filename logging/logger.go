@@ -0,0 +1,202 @@
+// Package logging writes levelled, structured log lines as JSON, a message and its fields,
+// with the credentials and secrets masked.
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Logger writes a JSON object per line, such as
+//
+//	{"time": "2019-02-05T23:01:31.123Z", "level": "info", "msg": "Inserted order", "requestId": "...", "orderId": "..."}
+//
+// Loggers made With fields share the output and level of their parent. They are safe for concurrent use.
+type Logger struct {
+	core   *core
+	fields []interface{}
+}
+
+// core is what a Logger shares with the loggers made from it
+type core struct {
+	mu       sync.Mutex
+	out      io.Writer
+	redactor *Redactor
+	level    Level
+}
+
+// New creates a Logger writing the lines at level and above to out, masking what redactor knows about
+func New(out io.Writer, redactor *Redactor, level Level) *Logger {
+	return &Logger{core: &core{out: out, redactor: redactor, level: level}}
+}
+
+// With returns a Logger adding the fields, given as key, value, key, value..., to every line
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyvals...)
+	return &Logger{core: l.core, fields: fields}
+}
+
+// SetLevel Drops the lines below level, of this Logger and of those sharing its output
+func (l *Logger) SetLevel(level Level) {
+	l.core.mu.Lock()
+	defer l.core.mu.Unlock()
+	l.core.level = level
+}
+
+// Debug writes msg and the fields, given as key, value, key, value..., at the debug level
+func (l *Logger) Debug(msg string, keyvals ...interface{}) {
+	l.write(LevelDebug, msg, keyvals)
+}
+
+// Info writes msg and the fields at the info level
+func (l *Logger) Info(msg string, keyvals ...interface{}) {
+	l.write(LevelInfo, msg, keyvals)
+}
+
+// Warn writes msg and the fields at the warn level
+func (l *Logger) Warn(msg string, keyvals ...interface{}) {
+	l.write(LevelWarn, msg, keyvals)
+}
+
+// Error writes msg and the fields at the error level
+func (l *Logger) Error(msg string, keyvals ...interface{}) {
+	l.write(LevelError, msg, keyvals)
+}
+
+// Fatal writes msg and the fields at the error level and exits
+func (l *Logger) Fatal(msg string, keyvals ...interface{}) {
+	l.write(LevelError, msg, keyvals)
+	os.Exit(1)
+}
+
+// write writes a line unless its level is dropped.
+// The values of fields such as password, token or accessKey are masked entirely, the others are redacted.
+func (l *Logger) write(level Level, msg string, keyvals []interface{}) {
+	l.core.mu.Lock()
+	defer l.core.mu.Unlock()
+	if level < l.core.level {
+		return
+	}
+
+	var line bytes.Buffer
+	line.WriteString(`{"time":`)
+	writeJSON(&line, time.Now().UTC().Format("2006-01-02T15:04:05.000Z07:00"))
+	line.WriteString(`,"level":`)
+	writeJSON(&line, level.String())
+	line.WriteString(`,"msg":`)
+	writeJSON(&line, l.core.redactor.Redact(msg))
+
+	fields := append(append([]interface{}{}, l.fields...), keyvals...)
+	for i := 0; i < len(fields); i += 2 {
+		key := fmt.Sprint(fields[i])
+		var value interface{} = "!MISSING"
+		if i+1 < len(fields) {
+			value = fields[i+1]
+		}
+		line.WriteString(",")
+		writeJSON(&line, key)
+		line.WriteString(":")
+		writeJSON(&line, l.fieldValue(key, value))
+	}
+	line.WriteString("}\n")
+
+	l.core.out.Write(line.Bytes())
+}
+
+// fieldValue returns the value as it is logged: numbers and booleans as is, everything else as a masked string
+func (l *Logger) fieldValue(key string, value interface{}) interface{} {
+	if isSecretField(key) {
+		return Mask
+	}
+	switch v := value.(type) {
+	case bool, int, int32, int64, uint, uint32, uint64, float32, float64:
+		return v
+	case error:
+		return l.core.redactor.Redact(v.Error())
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	}
+	return l.core.redactor.Redact(fmt.Sprint(value))
+}
+
+// writeJSON writes v as JSON, without escaping HTML
+func writeJSON(buf *bytes.Buffer, v interface{}) {
+	encoder := json.NewEncoder(buf)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(v)
+	// Encode ends with a newline
+	buf.Truncate(buf.Len() - 1)
+}
+
+// stdlibWriter turns the lines of the log package into info lines
+type stdlibWriter struct {
+	logger *Logger
+}
+
+// Write writes p, one line of the log package, at the info level
+func (w stdlibWriter) Write(p []byte) (int, error) {
+	w.logger.Info(strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
+
+// The redactor and logger of the service
+var (
+	std    = NewRedactor()
+	logger = New(os.Stderr, std, LevelInfo)
+)
+
+// SetOutput Sends the lines at level and above, including those of the log package at the info level, to w
+func SetOutput(w io.Writer, level Level) {
+	logger = New(w, std, level)
+	log.SetFlags(0)
+	log.SetOutput(stdlibWriter{logger: logger})
+}
+
+// Default Returns the logger of the service
+func Default() *Logger {
+	return logger
+}
+
+// AddSecret Masks the secret in every line from now on
+func AddSecret(secret string) {
+	std.AddSecret(secret)
+}
+
+// Redact Returns s masked like a log line
+func Redact(s string) string {
+	return std.Redact(s)
+}
+
+// Debug Writes msg and the fields, given as key, value, key, value..., at the debug level
+func Debug(msg string, keyvals ...interface{}) {
+	logger.Debug(msg, keyvals...)
+}
+
+// Info Writes msg and the fields at the info level
+func Info(msg string, keyvals ...interface{}) {
+	logger.Info(msg, keyvals...)
+}
+
+// Warn Writes msg and the fields at the warn level
+func Warn(msg string, keyvals ...interface{}) {
+	logger.Warn(msg, keyvals...)
+}
+
+// Error Writes msg and the fields at the error level
+func Error(msg string, keyvals ...interface{}) {
+	logger.Error(msg, keyvals...)
+}
+
+// Fatal Writes msg and the fields at the error level and exits
+func Fatal(msg string, keyvals ...interface{}) {
+	logger.Fatal(msg, keyvals...)
+}
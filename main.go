@@ -1,15 +1,38 @@
 package main
 
 import (
+	"captureorderfd/logging"
+	"captureorderfd/models"
 	_ "captureorderfd/routers"
+	"os"
 
 	"github.com/astaxie/beego"
 )
 
 func main() {
+	// captureorder replay-deadletters publishes the dead lettered events again and exits
+	if len(os.Args) > 1 && os.Args[1] == "replay-deadletters" {
+		replayDeadLetters()
+		return
+	}
+
+	models.Init()
+
 	if beego.BConfig.RunMode == "dev" {
 		beego.BConfig.WebConfig.DirectoryIndex = true
 		beego.BConfig.WebConfig.StaticDir["/swagger"] = "swagger"
 	}
 	beego.Run()
 }
+
+func replayDeadLetters() {
+	models.Setup()
+
+	replayed, err := models.ReplayDeadLetters()
+	models.ShutdownTracing()
+	logging.Info("Replayed dead letters", "count", replayed)
+	if err != nil {
+		logging.Error("Problem replaying dead letters", "error", err)
+		os.Exit(1)
+	}
+}
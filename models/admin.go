@@ -0,0 +1,93 @@
+package models
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"captureorderfd/logging"
+	"captureorderfd/msauth"
+)
+
+// ErrAdminDisabled is returned by AuthorizeAdmin when no admin key is configured
+var ErrAdminDisabled = errors.New("the admin API is disabled, set ADMIN_KEY or ADMIN_KEY_FILE")
+
+// ErrAdminUnauthorized is returned by AuthorizeAdmin when the request has no shared access signature
+var ErrAdminUnauthorized = errors.New("the admin API needs a shared access signature in the Authorization header")
+
+// The keys admin tokens are verified with, nil while the admin API is disabled.
+// Set with the ADMIN_KEY_NAME (admin by default) and ADMIN_KEY environment variables,
+// or the ADMIN_KEY_FILE environment variable, a file of keys reloaded every adminKeyReload, see msauth.KeyRing.LoadFile.
+var adminKeys *msauth.KeyRing
+var adminKeyFile string
+
+// How often the admin key file is reloaded, so keys rotate without a restart
+const adminKeyReload = time.Minute
+
+// initAdmin reads the admin keys from ADMIN_KEY or ADMIN_KEY_FILE. Without any, or with both, the admin API refuses every request.
+func initAdmin() {
+	adminKeys = nil
+	adminKeyFile = os.Getenv("ADMIN_KEY_FILE")
+	key := os.Getenv("ADMIN_KEY")
+
+	switch {
+	case key != "" && adminKeyFile != "":
+		logging.Error("Set either ADMIN_KEY or ADMIN_KEY_FILE, not both. The admin API is disabled.", "file", adminKeyFile)
+	case key != "":
+		name := os.Getenv("ADMIN_KEY_NAME")
+		if name == "" {
+			name = "admin"
+		}
+		adminKeys = msauth.NewKeyRing(msauth.Key{Name: name, Value: key})
+		logging.Info("The admin API needs shared access signatures signed with the admin key.", "keyName", name)
+	case adminKeyFile != "":
+		keys := msauth.NewKeyRing(msauth.Key{})
+		if err := keys.LoadFile(adminKeyFile); err != nil {
+			logging.Error("Problem loading the admin keys, the admin API is disabled", "file", adminKeyFile, "error", err)
+			return
+		}
+		addKeySecrets(keys)
+		adminKeys = keys
+		go reloadAdminKeys(keys)
+		logging.Info("The admin API needs shared access signatures signed with the admin keys.", "keyName", keys.Active().Name, "file", adminKeyFile)
+	default:
+		logging.Warn("The admin API is disabled. You can enable it by setting the ADMIN_KEY or ADMIN_KEY_FILE environment variable.")
+	}
+}
+
+// reloadAdminKeys reloads the admin key file every adminKeyReload, keeping the keys it has when the file is invalid
+func reloadAdminKeys(keys *msauth.KeyRing) {
+	for range time.Tick(adminKeyReload) {
+		if err := keys.LoadFile(adminKeyFile); err != nil {
+			logging.Error("Problem reloading the admin keys", "file", adminKeyFile, "error", err)
+			continue
+		}
+		addKeySecrets(keys)
+	}
+}
+
+// addKeySecrets masks the keys in the logs
+func addKeySecrets(keys *msauth.KeyRing) {
+	for _, key := range keys.Keys() {
+		logging.AddSecret(key.Value)
+	}
+}
+
+// AuthorizeAdmin Checks the Authorization header of an admin request holds a shared access signature,
+// signed with an admin key, unexpired and for the requested resource or a parent of it, e.g. https://<host>/v1/admin.
+// It returns ErrAdminDisabled, ErrAdminUnauthorized or one of the msauth errors when the request isn't authorized.
+func AuthorizeAdmin(authorization string, resourceURI string) error {
+	keys := adminKeys
+	if keys == nil {
+		return ErrAdminDisabled
+	}
+	if authorization == "" {
+		return ErrAdminUnauthorized
+	}
+
+	token, err := msauth.ParseToken(authorization)
+	if err != nil {
+		return err
+	}
+	return keys.Verify(token, resourceURI, time.Now())
+}
@@ -0,0 +1,84 @@
+package models
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"captureorderfd/msauth"
+)
+
+func TestAuthorizeAdmin(t *testing.T) {
+	defer func() { adminKeys = nil }()
+	const resource = "captureorder.example.com/v1/admin/outbox"
+
+	adminKeys = nil
+	if err := AuthorizeAdmin("", resource); err != ErrAdminDisabled {
+		t.Errorf("Without keys AuthorizeAdmin returned %v, expected ErrAdminDisabled", err)
+	}
+
+	adminKeys = msauth.NewKeyRing(msauth.Key{Name: "admin", Value: "adminSecret"})
+	inAnHour := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	anHourAgo := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	otherKey := msauth.New("", "admin", "otherSecret")
+
+	for _, test := range []struct {
+		name          string
+		authorization string
+		expected      error
+	}{
+		{"admin token", adminKeys.Sign("https://captureorder.example.com/v1/admin", inAnHour), nil},
+		{"token for the outbox", adminKeys.Sign("https://captureorder.example.com/v1/admin/outbox", inAnHour), nil},
+		{"no token", "", ErrAdminUnauthorized},
+		{"basic auth", "Basic YWRtaW46YWRtaW4=", msauth.ErrMalformedToken},
+		{"other key", otherKey.Sign("https://captureorder.example.com/v1/admin", inAnHour), msauth.ErrInvalidSignature},
+		{"expired", adminKeys.Sign("https://captureorder.example.com/v1/admin", anHourAgo), msauth.ErrTokenExpired},
+		{"orders token", adminKeys.Sign("https://captureorder.example.com/v1/order", inAnHour), msauth.ErrTokenScope},
+		{"other host", adminKeys.Sign("https://elsewhere.example.com/v1/admin", inAnHour), msauth.ErrTokenScope},
+	} {
+		if err := AuthorizeAdmin(test.authorization, resource); err != test.expected {
+			t.Errorf("%s: AuthorizeAdmin returned %v, expected %v", test.name, err, test.expected)
+		}
+	}
+}
+
+func TestInitAdmin(t *testing.T) {
+	defer func() { adminKeys = nil }()
+	defer os.Setenv("ADMIN_KEY", "")
+	defer os.Setenv("ADMIN_KEY_FILE", "")
+
+	file, err := ioutil.TempFile("", "admin-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("SharedAccessKeyName=ops;SharedAccessKey=fileSecret\n")
+	file.Close()
+
+	for _, test := range []struct {
+		name    string
+		key     string
+		keyFile string
+		active  string
+	}{
+		{"nothing", "", "", ""},
+		{"key", "envSecret", "", "envSecret"},
+		{"key file", "", file.Name(), "fileSecret"},
+		{"missing key file", "", file.Name() + ".missing", ""},
+		{"both", "envSecret", file.Name(), ""},
+	} {
+		os.Setenv("ADMIN_KEY", test.key)
+		os.Setenv("ADMIN_KEY_FILE", test.keyFile)
+		initAdmin()
+
+		active := ""
+		if adminKeys != nil {
+			active = adminKeys.Active().Value
+		}
+		if active != test.active {
+			t.Errorf("%s: the admin API signs with %q, expected %q", test.name, active, test.active)
+		}
+	}
+}
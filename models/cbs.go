@@ -0,0 +1,162 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"captureorderfd/msauth"
+
+	"gopkg.in/mgo.v2/bson"
+	amqp10 "pack.ag/amqp"
+)
+
+// Claims-based security (CBS) node of Service Bus and Event Hubs, where tokens are put
+const cbsAddress = "$cbs"
+
+// Type of the tokens signed by msauth
+const cbsTokenType = "servicebus.windows.net:sastoken"
+
+// How long the tokens put on the CBS node are valid, they are replaced once cbsRefreshFraction of that has passed
+const cbsTokenLifetime = time.Hour
+const cbsRefreshFraction = 0.9
+
+// File with the keys of the Service Bus policy, e.g. a mounted secret, see msauth.KeyRing.LoadFile.
+// It is reloaded every serviceBusKeyReload, so keys rotate without a restart. Set with the SERVICEBUS_KEY_FILE environment variable.
+var serviceBusKeyFile string
+
+// How often the key file is reloaded. Override with the SERVICEBUS_KEY_RELOAD environment variable, e.g. 30s
+var serviceBusKeyReload = time.Minute
+
+// isServiceBusConnectionString tells whether AMQPURL is a connection string rather than a URL
+func isServiceBusConnectionString(value string) bool {
+	return strings.HasPrefix(strings.ToLower(strings.TrimSpace(value)), "endpoint=")
+}
+
+// cbsAuth authorizes a connection to send to an entity, by putting a SAS token for it on the CBS node
+type cbsAuth struct {
+	keys     *msauth.KeyRing
+	tokens   *msauth.TokenProvider
+	audience string // amqp://<host>/<entity path>
+}
+
+// newCBSAuth signs tokens for the entity of the connection string with its shared access key,
+// or with the keys of the key file when there is one
+func newCBSAuth(cs *msauth.ConnectionString) (*cbsAuth, error) {
+	if cs.EntityPath == "" {
+		return nil, errors.New("connection string has no EntityPath, the queue or event hub to send to")
+	}
+	keys, err := cs.KeyRing()
+	if err != nil {
+		return nil, err
+	}
+	if serviceBusKeyFile != "" {
+		if err := keys.LoadFile(serviceBusKeyFile); err != nil {
+			return nil, err
+		}
+	}
+	return &cbsAuth{
+		keys:     keys,
+		tokens:   msauth.NewTokenProvider(keys, cbsTokenLifetime, cbsRefreshFraction),
+		audience: "amqp://" + cs.Host + "/" + cs.EntityPath,
+	}, nil
+}
+
+// reloadKeys reloads the key file, and tells whether the active key changed.
+// When it did, the cached token is signed again with the new key.
+func (a *cbsAuth) reloadKeys() (bool, error) {
+	active := a.keys.Active()
+	if err := a.keys.LoadFile(serviceBusKeyFile); err != nil {
+		return false, err
+	}
+	if a.keys.Active() == active {
+		return false, nil
+	}
+	a.tokens.Refresh(a.audience)
+	return true, nil
+}
+
+// close stops refreshing the cached token, msauth.TokenProvider.Close makes it safe to call more than once
+func (a *cbsAuth) close() {
+	a.tokens.Close()
+}
+
+// putTokenMessage wraps a token in a put-token request
+func (a *cbsAuth) putTokenMessage(token msauth.AccessToken, replyTo string) *amqp10.Message {
+	return &amqp10.Message{
+		Properties: &amqp10.MessageProperties{
+			MessageID: bson.NewObjectId().Hex(),
+			ReplyTo:   replyTo,
+		},
+		ApplicationProperties: map[string]interface{}{
+			"operation":  "put-token",
+			"type":       cbsTokenType,
+			"name":       a.audience,
+			"expiration": msauth.SignatureExpiry(token.Expiry, 0),
+		},
+		Value: token.Token,
+	}
+}
+
+// putToken sends the current token to the CBS node of the connection and waits for it to be accepted.
+// The token tells when to put the next one.
+func (a *cbsAuth) putToken(ctx context.Context, client *amqp10.Client) (msauth.AccessToken, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return msauth.AccessToken{}, err
+	}
+	defer session.Close(ctx)
+
+	// The CBS node answers on the link whose target is the reply-to address of the request
+	replyTo := cbsAddress + "-reply-" + bson.NewObjectId().Hex()
+	sender, err := session.NewSender(amqp10.LinkTargetAddress(cbsAddress))
+	if err != nil {
+		return msauth.AccessToken{}, err
+	}
+	receiver, err := session.NewReceiver(amqp10.LinkSourceAddress(cbsAddress), amqp10.LinkTargetAddress(replyTo))
+	if err != nil {
+		return msauth.AccessToken{}, err
+	}
+
+	token := a.tokens.Token(a.audience)
+	if err = sender.Send(ctx, a.putTokenMessage(token, replyTo)); err != nil {
+		return msauth.AccessToken{}, err
+	}
+
+	response, err := receiver.Receive(ctx)
+	if err != nil {
+		return msauth.AccessToken{}, err
+	}
+	if err = cbsResponseError(response); err != nil {
+		return msauth.AccessToken{}, err
+	}
+	return token, nil
+}
+
+// cbsResponseError returns an error unless the CBS node answered 200 OK or 202 Accepted
+func cbsResponseError(response *amqp10.Message) error {
+	var code int64
+	switch status := response.ApplicationProperties["status-code"].(type) {
+	case int32:
+		code = int64(status)
+	case int64:
+		code = status
+	case int:
+		code = int64(status)
+	}
+	if code == 200 || code == 202 {
+		return nil
+	}
+	return fmt.Errorf("the CBS node refused the token: %d %v", code, response.ApplicationProperties["status-description"])
+}
+
+// cbsRefreshDelay is how long to wait before putting a new token in place of the current one
+func cbsRefreshDelay(current msauth.AccessToken) time.Duration {
+	delay := time.Until(current.RefreshAt)
+	if delay < 0 {
+		return 0
+	}
+	return delay
+}
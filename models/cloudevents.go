@@ -0,0 +1,65 @@
+package models
+
+import (
+	"net/url"
+	"os"
+	"time"
+)
+
+// CloudEvents 1.0, see https://github.com/cloudevents/spec/blob/v1.0/spec.md
+const cloudEventsSpecVersion = "1.0"
+const cloudEventsContentType = "application/cloudevents+json"
+
+// Prefix of the CloudEvents attributes in binary mode headers
+const cloudEventsHeaderPrefix = "ce-"
+
+// Prefix of the CloudEvents type, followed by the event kind, e.g. captureorder.OrderCreated
+const cloudEventTypePrefix = "captureorder."
+
+// cloudEvent is an OrderEvent in CloudEvents structured mode
+type cloudEvent struct {
+	SpecVersion     string     `json:"specversion"`
+	ID              string     `json:"id"`
+	Source          string     `json:"source"`
+	Type            string     `json:"type"`
+	Subject         string     `json:"subject"`
+	Time            time.Time  `json:"time"`
+	DataContentType string     `json:"datacontenttype"`
+	Data            OrderEvent `json:"data"`
+}
+
+// newCloudEvent wraps an OrderEvent, the order id is the subject
+func newCloudEvent(event OrderEvent) cloudEvent {
+	return cloudEvent{
+		SpecVersion:     cloudEventsSpecVersion,
+		ID:              event.ID,
+		Source:          cloudEventSource(),
+		Type:            cloudEventTypePrefix + event.Type,
+		Subject:         event.Order.OrderID,
+		Time:            event.Time,
+		DataContentType: "application/json",
+		Data:            event,
+	}
+}
+
+// headers returns the CloudEvents attributes as binary mode headers.
+// The data content type is the content type of the message itself.
+func (e cloudEvent) headers() map[string]string {
+	return map[string]string{
+		cloudEventsHeaderPrefix + "specversion": e.SpecVersion,
+		cloudEventsHeaderPrefix + "id":          e.ID,
+		cloudEventsHeaderPrefix + "source":      e.Source,
+		cloudEventsHeaderPrefix + "type":        e.Type,
+		cloudEventsHeaderPrefix + "subject":     e.Subject,
+		cloudEventsHeaderPrefix + "time":        e.Time.Format(time.RFC3339Nano),
+	}
+}
+
+// cloudEventSource identifies this service as /captureorder/TEAMNAME, followed by /SOURCE when it is set
+func cloudEventSource() string {
+	source := "/captureorder/" + url.PathEscape(teamName)
+	if backend := os.Getenv("SOURCE"); backend != "" {
+		source += "/" + url.PathEscape(backend)
+	}
+	return source
+}
@@ -0,0 +1,199 @@
+package models
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"captureorderfd/logging"
+)
+
+// DeadLetter is an outbox event the relay gave up on, along with why
+type DeadLetter struct {
+	OrderID        string      `json:"orderId"`
+	Event          OutboxEvent `json:"event"`
+	Reason         string      `json:"reason"`
+	Attempts       int         `json:"attempts"`
+	DeadLetteredAt time.Time   `json:"deadLetteredAt"`
+}
+
+// DeadLetterSink keeps the events that could not be published until they are replayed.
+// Implementations must be safe for concurrent use.
+type DeadLetterSink interface {
+	// Put stores a dead letter durably
+	Put(letter DeadLetter) error
+	// Replay hands every stored dead letter to publish, and forgets the ones it published.
+	// It returns how many were published.
+	Replay(publish func(DeadLetter) error) (int, error)
+}
+
+// Directory where dead letters are spooled. Override with the DEADLETTER_DIR environment variable.
+var deadLetterDir = "deadletters"
+
+// The dead letter sink in use, set up by Setup
+var deadLetters DeadLetterSink
+
+// initDeadLetters sets up the dead letter sink, the RabbitMQ dead letter exchange when configured, otherwise the spool directory
+func initDeadLetters() {
+	if dir := os.Getenv("DEADLETTER_DIR"); dir != "" {
+		deadLetterDir = dir
+	}
+
+	spool := &spoolDeadLetterSink{dir: deadLetterDir}
+	deadLetters = spool
+	if p, ok := publisher.(*amqp091Publisher); ok && p.topology.DeadLetterExchange != "" {
+		deadLetters = &amqpDeadLetterSink{publisher: p, fallback: spool}
+		logging.Info("Dead letters go to the exchange, or to the directory when RabbitMQ is unavailable.", "exchange", p.topology.DeadLetterExchange, "dir", deadLetterDir)
+		return
+	}
+	logging.Info("Dead letters go to the directory. You can override by setting the DEADLETTER_DIR environment variable.", "dir", deadLetterDir)
+}
+
+// deadLetterEvent hands an event the relay gave up on to the dead letter sink and takes it out of the outbox
+func deadLetterEvent(pending PendingEvent, reason error) error {
+	letter := DeadLetter{
+		OrderID:        pending.OrderID,
+		Event:          pending.Event,
+		Reason:         reason.Error(),
+		Attempts:       pending.Event.Attempts + 1,
+		DeadLetteredAt: time.Now().UTC(),
+	}
+	if err := deadLetters.Put(letter); err != nil {
+		return err
+	}
+
+	logging.FromContext(eventContext(pending.Event)).Warn("Dead lettered the event", "kind", pending.Event.Kind, "eventId", pending.Event.ID, "orderId", pending.OrderID, "attempts", letter.Attempts, "reason", letter.Reason)
+	return orderStore.MarkEventDeadLettered(pending.OrderID, pending.Event.ID, letter.Reason)
+}
+
+// ReplayDeadLetters Publishes the dead lettered events again, and marks them sent in the outbox.
+// Call Setup first. It returns how many events were published.
+func ReplayDeadLetters() (int, error) {
+	if publisher == nil {
+		return 0, ErrPublisherNotConnected
+	}
+
+	return deadLetters.Replay(func(letter DeadLetter) error {
+		if err := publishEvent(letter.OrderID, letter.Event); err != nil {
+			return err
+		}
+
+		// The order may be gone since, the event was published all the same
+		err := orderStore.MarkEventSent(letter.OrderID, letter.Event.ID, time.Now().UTC())
+		if err != nil && err != ErrOrderNotFound && err != ErrEventNotFound {
+			ctx := eventContext(letter.Event)
+			trackException(ctx, err)
+			logging.FromContext(ctx).Error("Problem updating the outbox", "eventId", letter.Event.ID, "orderId", letter.OrderID, "error", err)
+		}
+		return nil
+	})
+}
+
+// spoolDeadLetterSink writes every dead letter to its own JSON file in a directory
+type spoolDeadLetterSink struct {
+	dir string
+}
+
+// Put writes the dead letter to a temporary file, syncs it and renames it, so a file is either complete or absent
+func (s *spoolDeadLetterSink) Put(letter DeadLetter) error {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(s.dir, ".deadletter")
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(data); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	// Event ids are ObjectIds, so the files sort oldest first
+	return os.Rename(file.Name(), filepath.Join(s.dir, letter.Event.ID+"-"+letter.OrderID+".json"))
+}
+
+// Replay publishes the spooled dead letters oldest first, ReadDir sorts them by name, and removes the published ones.
+// It stops at the first one that can't be published.
+func (s *spoolDeadLetterSink) Replay(publish func(DeadLetter) error) (int, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	replayed := 0
+	for _, file := range files {
+		// Skip unfinished temporary files
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+
+		path := filepath.Join(s.dir, file.Name())
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return replayed, err
+		}
+
+		var letter DeadLetter
+		if err := json.Unmarshal(data, &letter); err != nil {
+			logging.Warn("Skipping malformed dead letter", "path", path, "error", err)
+			continue
+		}
+
+		if err := publish(letter); err != nil {
+			return replayed, err
+		}
+		replayed++
+
+		if err := os.Remove(path); err != nil {
+			return replayed, err
+		}
+	}
+	return replayed, nil
+}
+
+// amqpDeadLetterSink publishes dead letters to the RabbitMQ dead letter exchange,
+// and spools them when RabbitMQ doesn't take them
+type amqpDeadLetterSink struct {
+	publisher *amqp091Publisher
+	fallback  *spoolDeadLetterSink
+}
+
+// Put publishes the dead letter, or spools it
+func (s *amqpDeadLetterSink) Put(letter DeadLetter) error {
+	err := s.publisher.publishDeadLetter(letter)
+	if err == nil {
+		return nil
+	}
+
+	logging.Warn("Problem publishing a dead letter to RabbitMQ, spooling it", "eventId", letter.Event.ID, "error", err)
+	return s.fallback.Put(letter)
+}
+
+// Replay replays the spooled dead letters, then the ones in the dead letter queue
+func (s *amqpDeadLetterSink) Replay(publish func(DeadLetter) error) (int, error) {
+	spooled, err := s.fallback.Replay(publish)
+	if err != nil {
+		return spooled, err
+	}
+
+	queued, err := s.publisher.replayDeadLetters(publish)
+	return spooled + queued, err
+}
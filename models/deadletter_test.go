@@ -0,0 +1,65 @@
+package models
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDeadLetterAndReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deadletters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	orderStore = newMemoryStore()
+	deadLetters = &spoolDeadLetterSink{dir: dir}
+	publisher = newMemoryPublisher(0) // always full
+	defer func() { publisher, deadLetters = nil, nil }()
+
+	// The last attempt fails
+	confirm := StatusTransition{From: StatusOpen, To: StatusConfirmed, At: time.Now()}
+	order := newTestOrder("test@domain.com", time.Now())
+	event := newStatusChangedEvent(order, confirm, "")
+	event.Attempts = outboxMaxAttempts - 1
+	order.Outbox = []OutboxEvent{event}
+	orderStore.Create(context.Background(), order)
+
+	relayOutbox()
+
+	stored, _ := orderStore.Get(context.Background(), order.OrderID)
+	if state := stored.Outbox[0].State; state != OutboxDeadLettered {
+		t.Fatalf("The event is %s, expected %s", state, OutboxDeadLettered)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Fatalf("%d dead letters were spooled, expected 1", len(files))
+	}
+	if pending, _ := orderStore.PendingEvents(time.Now().Add(time.Hour), 10); len(pending) != 0 {
+		t.Errorf("The dead lettered event is still pending: %+v", pending)
+	}
+
+	// Replaying fails while the broker doesn't take messages, and keeps the dead letter
+	if replayed, err := ReplayDeadLetters(); replayed != 0 || err != ErrPublisherFull {
+		t.Errorf("Replaying to a full broker returned %d, %v", replayed, err)
+	}
+
+	publisher = newMemoryPublisher(1)
+	if replayed, err := ReplayDeadLetters(); replayed != 1 || err != nil {
+		t.Fatalf("Replaying returned %d, %v, expected 1 dead letter", replayed, err)
+	}
+	if received := <-MemoryMessages(); received.ID != event.ID {
+		t.Errorf("Replayed %+v, expected event %s", received, event.ID)
+	}
+
+	stored, _ = orderStore.Get(context.Background(), order.OrderID)
+	if state := stored.Outbox[0].State; state != OutboxSent {
+		t.Errorf("The replayed event is %s, expected %s", state, OutboxSent)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("%d dead letters are left after replaying", len(files))
+	}
+}
@@ -0,0 +1,100 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// OrderEventSchemaVersion is the version of the OrderEvent schema.
+// The minor version changes when fields are added, the major version when fields change or go away.
+const OrderEventSchemaVersion = "1.0"
+
+// Supported EVENT_FORMAT values
+const (
+	EventFormatEnvelope          = "envelope"
+	EventFormatLegacy            = "legacy"
+	EventFormatCloudEvents       = "cloudevents"        // CloudEvents structured mode
+	EventFormatCloudEventsBinary = "cloudevents-binary" // CloudEvents binary mode
+)
+
+// isEventFormat tells whether format is a supported EVENT_FORMAT value
+func isEventFormat(format string) bool {
+	switch format {
+	case EventFormatEnvelope, EventFormatLegacy, EventFormatCloudEvents, EventFormatCloudEventsBinary:
+		return true
+	}
+	return false
+}
+
+// The shape of the published events. Override with the EVENT_FORMAT environment variable.
+var eventFormat = EventFormatEnvelope
+
+// OrderEvent is the body of every message published about an order
+type OrderEvent struct {
+	ID            string            `json:"id" description:"Unique event id, also sent as the message id. Use it to drop duplicates."`
+	Type          string            `json:"type" description:"OrderCreated or OrderStatusChanged"`
+	SchemaVersion string            `json:"schemaVersion" description:"Version of this schema, currently 1.0"`
+	Time          time.Time         `json:"time" description:"When the event happened"`
+	Source        string            `json:"source" description:"Team that captured the order"`
+	CorrelationID string            `json:"correlationId,omitempty" description:"X-Correlation-ID of the request that caused the event"`
+	Order         Order             `json:"order" description:"The order as it was right after the event"`
+	Transition    *StatusTransition `json:"transition,omitempty" description:"The status change, only for OrderStatusChanged"`
+}
+
+// legacyOrderCreated is the body published for a new order before OrderEvent existed
+type legacyOrderCreated struct {
+	Order  string `json:"order"`
+	Source string `json:"source"`
+}
+
+// legacyOrderStatusChanged is the body published for a status change before OrderEvent existed
+type legacyOrderStatusChanged struct {
+	Order          string `json:"order"`
+	Source         string `json:"source"`
+	Event          string `json:"event"`
+	Status         string `json:"status"`
+	PreviousStatus string `json:"previousStatus"`
+}
+
+// encodeOrderEvent serialises an event in the configured format and returns it along with its content type
+// and, in CloudEvents binary mode, the message headers
+func encodeOrderEvent(id string, kind string, at time.Time, order Order, transition *StatusTransition, correlationID string) ([]byte, string, map[string]string) {
+	order.Outbox = nil
+	envelope := OrderEvent{
+		ID:            id,
+		Type:          kind,
+		SchemaVersion: OrderEventSchemaVersion,
+		Time:          at,
+		Source:        teamName,
+		CorrelationID: correlationID,
+		Order:         order,
+		Transition:    transition,
+	}
+
+	var event interface{} = envelope
+	contentType := "application/json"
+	var headers map[string]string
+
+	switch {
+	case eventFormat == EventFormatLegacy && transition == nil:
+		event = legacyOrderCreated{Order: order.OrderID, Source: teamName}
+	case eventFormat == EventFormatLegacy:
+		event = legacyOrderStatusChanged{
+			Order:          order.OrderID,
+			Source:         teamName,
+			Event:          "statusChanged",
+			Status:         transition.To,
+			PreviousStatus: transition.From,
+		}
+	case eventFormat == EventFormatCloudEvents:
+		event = newCloudEvent(envelope)
+		contentType = cloudEventsContentType
+	case eventFormat == EventFormatCloudEventsBinary:
+		// The envelope is the data, the CloudEvents attributes go in the headers
+		headers = newCloudEvent(envelope).headers()
+	}
+
+	// Only strings, numbers and times, so this can't fail
+	body, _ := json.Marshal(event)
+	return body, contentType, headers
+}
@@ -0,0 +1,91 @@
+package models
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestEncodeOrderEventEnvelope(t *testing.T) {
+	order := newTestOrder("test@domain.com", time.Now())
+	order.Product = `Fancy "quoted" product`
+	confirm := StatusTransition{From: StatusOpen, To: StatusConfirmed, At: time.Now().UTC()}
+
+	body, contentType, _ := encodeOrderEvent("1", EventOrderStatusChanged, confirm.At, order, &confirm, "abc")
+	if contentType != "application/json" {
+		t.Errorf("Content type is %s, expected application/json", contentType)
+	}
+
+	var event OrderEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		t.Fatalf("The envelope is not valid JSON: %v\n%s", err, body)
+	}
+	if event.ID != "1" || event.Type != EventOrderStatusChanged || event.SchemaVersion != OrderEventSchemaVersion || event.CorrelationID != "abc" {
+		t.Errorf("Unexpected envelope %+v", event)
+	}
+	if event.Order.Product != order.Product || event.Transition == nil || event.Transition.To != StatusConfirmed {
+		t.Errorf("The envelope lost the order or transition: %+v", event)
+	}
+}
+
+func TestEncodeOrderEventLegacy(t *testing.T) {
+	eventFormat = EventFormatLegacy
+	teamName = `The "quoted" team`
+	defer func() { eventFormat, teamName = EventFormatEnvelope, "" }()
+
+	order := newTestOrder("test@domain.com", time.Now())
+	body, _, _ := encodeOrderEvent("1", EventOrderCreated, time.Now(), order, nil, "")
+
+	var legacy map[string]string
+	if err := json.Unmarshal(body, &legacy); err != nil {
+		t.Fatalf("The legacy body is not valid JSON: %v\n%s", err, body)
+	}
+	if len(legacy) != 2 || legacy["order"] != order.OrderID || legacy["source"] != teamName {
+		t.Errorf("Unexpected legacy body %s", body)
+	}
+}
+
+func TestEncodeOrderEventCloudEvents(t *testing.T) {
+	teamName = "team one"
+	defer func() { eventFormat, teamName = EventFormatEnvelope, "" }()
+	order := newTestOrder("test@domain.com", time.Now())
+
+	eventFormat = EventFormatCloudEvents
+	body, contentType, headers := encodeOrderEvent("1", EventOrderCreated, time.Now(), order, nil, "")
+	if contentType != "application/cloudevents+json" || headers != nil {
+		t.Errorf("Structured mode gave content type %s and headers %v", contentType, headers)
+	}
+
+	var structured map[string]interface{}
+	if err := json.Unmarshal(body, &structured); err != nil {
+		t.Fatalf("The structured event is not valid JSON: %v\n%s", err, body)
+	}
+	for attribute, expected := range map[string]string{
+		"specversion": "1.0",
+		"id":          "1",
+		"source":      "/captureorder/team%20one",
+		"type":        "captureorder.OrderCreated",
+		"subject":     order.OrderID,
+	} {
+		if structured[attribute] != expected {
+			t.Errorf("Structured mode %s is %v, expected %s", attribute, structured[attribute], expected)
+		}
+	}
+	if data, ok := structured["data"].(map[string]interface{}); !ok || data["type"] != EventOrderCreated {
+		t.Errorf("Structured mode data is %v, expected the OrderEvent", structured["data"])
+	}
+
+	eventFormat = EventFormatCloudEventsBinary
+	body, contentType, headers = encodeOrderEvent("1", EventOrderCreated, time.Now(), order, nil, "")
+	if contentType != "application/json" {
+		t.Errorf("Binary mode gave content type %s, expected application/json", contentType)
+	}
+	if headers["ce-specversion"] != "1.0" || headers["ce-id"] != "1" || headers["ce-type"] != "captureorder.OrderCreated" || headers["ce-time"] == "" {
+		t.Errorf("Unexpected binary mode headers %v", headers)
+	}
+
+	var event OrderEvent
+	if err := json.Unmarshal(body, &event); err != nil || event.Order.OrderID != order.OrderID {
+		t.Errorf("Binary mode body is %s, expected the OrderEvent", body)
+	}
+}
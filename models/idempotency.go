@@ -0,0 +1,157 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"captureorderfd/logging"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ErrInvalidIdempotencyKey is returned for an empty or overly long Idempotency-Key
+var ErrInvalidIdempotencyKey = errors.New("invalid idempotency key")
+
+// ErrIdempotencyKeyReused is returned when an Idempotency-Key is reused with a different request body
+var ErrIdempotencyKeyReused = errors.New("idempotency key reused with a different request")
+
+// ErrIdempotencyKeyInProgress is returned when the request that first used an Idempotency-Key hasn't finished yet
+var ErrIdempotencyKeyInProgress = errors.New("idempotency key in use by a request in progress")
+
+// MaxIdempotencyKeyLength is the longest Idempotency-Key accepted
+const MaxIdempotencyKeyLength = 255
+
+// How long an Idempotency-Key is remembered. Override with the IDEMPOTENCY_WINDOW environment variable, e.g. 1h
+var idempotencyWindow = 24 * time.Hour
+
+// How long the request that claimed an Idempotency-Key has to capture its order before a retry may take the key over.
+// It outlasts the MongoDB timeouts, so the insert of that request has succeeded or failed by then.
+// Override with the IDEMPOTENCY_LEASE environment variable, e.g. 2m
+var idempotencyLease = time.Minute
+
+// IdempotencyRecord ties an Idempotency-Key to the request that first used it and the order it creates.
+// The order id is chosen when the key is claimed, so a retry that takes the key over from a request that died
+// finds the order if it was captured, or captures it under the same id.
+// The records live in their own collection, where MongoDB expires them without touching the orders.
+type IdempotencyRecord struct {
+	Key         string    `bson:"_id"`
+	RequestHash string    `bson:"requesthash"`
+	OrderID     string    `bson:"orderid"`
+	CreatedAt   time.Time `bson:"createdat"`
+	// LeaseUntil is zero once the order is captured
+	LeaseUntil time.Time `bson:"leaseuntil"`
+}
+
+// completed tells whether the order of the key was captured
+func (record IdempotencyRecord) completed() bool {
+	return record.OrderID != "" && record.LeaseUntil.IsZero()
+}
+
+// ClaimIdempotencyKey Reserves an Idempotency-Key for a request body.
+// It returns the claim, whose OrderID the new order must be captured with, and false when the key is claimed,
+// or a record with the id of the order captured by an earlier request with the same key and body and true.
+// A key whose request didn't capture its order within idempotencyLease is taken over.
+func ClaimIdempotencyKey(ctx context.Context, key string, body []byte) (IdempotencyRecord, bool, error) {
+	if key == "" || len(key) > MaxIdempotencyKeyLength {
+		return IdempotencyRecord{}, false, ErrInvalidIdempotencyKey
+	}
+	logger := logging.FromContext(ctx)
+
+	hash := sha256.Sum256(body)
+	now := time.Now().UTC()
+	record := IdempotencyRecord{
+		Key:         key,
+		RequestHash: hex.EncodeToString(hash[:]),
+		OrderID:     bson.NewObjectId().Hex(),
+		CreatedAt:   now,
+		LeaseUntil:  now.Add(idempotencyLease),
+	}
+
+	existing, claimed, err := orderStore.Claim(record, idempotencyWindow)
+	if err != nil {
+		trackException(ctx, err)
+		logger.Error("Problem claiming the idempotency key", "idempotencyKey", key, "error", err)
+		return IdempotencyRecord{}, false, err
+	}
+	if claimed {
+		return record, false, nil
+	}
+
+	if existing.RequestHash != record.RequestHash {
+		return IdempotencyRecord{}, false, ErrIdempotencyKeyReused
+	}
+	if existing.completed() {
+		return existing, true, nil
+	}
+	if existing.LeaseUntil.After(now) {
+		return IdempotencyRecord{}, false, ErrIdempotencyKeyInProgress
+	}
+
+	// The request that claimed the key died or failed, but may have captured its order all the same
+	if existing.OrderID != "" {
+		_, err = orderStore.Get(ctx, existing.OrderID)
+		if err == nil {
+			logger.Info("Found the order of an abandoned idempotency key", "idempotencyKey", key, "orderId", existing.OrderID)
+			if err = CompleteIdempotencyKey(ctx, key, existing.OrderID); err != nil {
+				return IdempotencyRecord{}, false, err
+			}
+			existing.LeaseUntil = time.Time{}
+			return existing, true, nil
+		}
+		if err != ErrOrderNotFound {
+			trackException(ctx, err)
+			logger.Error("Problem looking for the order of the idempotency key", "idempotencyKey", key, "orderId", existing.OrderID, "error", err)
+			return IdempotencyRecord{}, false, err
+		}
+		// Keep the id. Should the insert of the original request land after all, the retry's insert is rejected as
+		// a duplicate by the unique order id and AddIdempotentOrder replays the order.
+		record.OrderID = existing.OrderID
+	}
+
+	takenOver, err := orderStore.TakeOver(existing, record.OrderID, record.LeaseUntil)
+	if err != nil {
+		trackException(ctx, err)
+		logger.Error("Problem taking over the idempotency key", "idempotencyKey", key, "error", err)
+		return IdempotencyRecord{}, false, err
+	}
+	if !takenOver {
+		return IdempotencyRecord{}, false, ErrIdempotencyKeyInProgress
+	}
+	logger.Info("Took over an abandoned idempotency key", "idempotencyKey", key, "orderId", record.OrderID)
+	return record, false, nil
+}
+
+// AddIdempotentOrder Adds the order under the id of a claimed Idempotency-Key.
+// If the request that claimed the key before captured the order after all, the order is not added again and the
+// captured order id is returned with true, for the key to be completed and the response replayed.
+func AddIdempotentOrder(ctx context.Context, claim IdempotencyRecord, order Order, correlationID string) (Order, bool, error) {
+	added, err := AddOrderWithID(ctx, claim.OrderID, order, correlationID)
+	if err == ErrDuplicateOrder {
+		logging.FromContext(ctx).Info("The order of the idempotency key was captured by an earlier request", "idempotencyKey", claim.Key, "orderId", claim.OrderID)
+		return Order{OrderID: claim.OrderID}, true, nil
+	}
+	return added, false, err
+}
+
+// CompleteIdempotencyKey Records the order captured for a claimed Idempotency-Key
+func CompleteIdempotencyKey(ctx context.Context, key string, orderID string) error {
+	err := orderStore.Complete(key, orderID)
+	if err != nil {
+		trackException(ctx, err)
+		logging.FromContext(ctx).Error("Problem recording the order for the idempotency key", "idempotencyKey", key, "orderId", orderID, "error", err)
+	}
+	return err
+}
+
+// ReleaseIdempotencyKey Ends the lease of a claimed Idempotency-Key whose order wasn't captured, so the client can retry straight away
+func ReleaseIdempotencyKey(ctx context.Context, claim IdempotencyRecord) error {
+	err := orderStore.Release(claim.Key, claim.LeaseUntil)
+	if err != nil {
+		trackException(ctx, err)
+		logging.FromContext(ctx).Error("Problem releasing the idempotency key", "idempotencyKey", claim.Key, "error", err)
+	}
+	return err
+}
@@ -0,0 +1,115 @@
+package models
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestClaimIdempotencyKey(t *testing.T) {
+	orderStore = newMemoryStore()
+	ctx := context.Background()
+	body := []byte(`{"EmailAddress": "test@domain.com"}`)
+
+	claim, replayed, err := ClaimIdempotencyKey(ctx, "key", body)
+	if err != nil || replayed || claim.OrderID == "" {
+		t.Fatalf("Claiming a new key returned %+v, %t, %v", claim, replayed, err)
+	}
+	if _, _, err := ClaimIdempotencyKey(ctx, "key", body); err != ErrIdempotencyKeyInProgress {
+		t.Errorf("Claiming a key in progress returned %v, expected ErrIdempotencyKeyInProgress", err)
+	}
+	if _, _, err := ClaimIdempotencyKey(ctx, "key", []byte(`{}`)); err != ErrIdempotencyKeyReused {
+		t.Errorf("Claiming a key with another body returned %v, expected ErrIdempotencyKeyReused", err)
+	}
+
+	order, err := AddOrderWithID(ctx, claim.OrderID, Order{EmailAddress: "test@domain.com"}, "")
+	if err != nil {
+		t.Fatalf("AddOrderWithID returned %v", err)
+	}
+	if err := CompleteIdempotencyKey(ctx, "key", order.OrderID); err != nil {
+		t.Fatalf("CompleteIdempotencyKey returned %v", err)
+	}
+
+	replay, replayed, err := ClaimIdempotencyKey(ctx, "key", body)
+	if err != nil || !replayed || replay.OrderID != claim.OrderID {
+		t.Errorf("Claiming a completed key returned %+v, %t, %v, expected order %s", replay, replayed, err, claim.OrderID)
+	}
+	if _, _, err := ClaimIdempotencyKey(ctx, "key", []byte(`{}`)); err != ErrIdempotencyKeyReused {
+		t.Errorf("Claiming a completed key with another body returned %v, expected ErrIdempotencyKeyReused", err)
+	}
+}
+
+func TestAbandonedIdempotencyKeyIsTakenOver(t *testing.T) {
+	orderStore = newMemoryStore()
+	defer func(lease time.Duration) { idempotencyLease = lease }(idempotencyLease)
+	idempotencyLease = time.Millisecond
+	ctx := context.Background()
+	body := []byte(`{"EmailAddress": "test@domain.com"}`)
+
+	// The first request dies after capturing the order, before completing the key
+	captured, _, _ := ClaimIdempotencyKey(ctx, "captured", body)
+	AddOrderWithID(ctx, captured.OrderID, Order{EmailAddress: "test@domain.com"}, "")
+	// The second dies before capturing it
+	lost, _, _ := ClaimIdempotencyKey(ctx, "lost", body)
+	time.Sleep(5 * time.Millisecond)
+	idempotencyLease = time.Hour
+
+	replay, replayed, err := ClaimIdempotencyKey(ctx, "captured", body)
+	if err != nil || !replayed || replay.OrderID != captured.OrderID {
+		t.Errorf("Retrying a captured order returned %+v, %t, %v, expected order %s", replay, replayed, err, captured.OrderID)
+	}
+	if replay, replayed, err = ClaimIdempotencyKey(ctx, "captured", body); !replayed {
+		t.Errorf("The key of the captured order wasn't completed: %+v, %v", replay, err)
+	}
+
+	retry, replayed, err := ClaimIdempotencyKey(ctx, "lost", body)
+	if err != nil || replayed || retry.OrderID != lost.OrderID {
+		t.Errorf("Retrying a lost order returned %+v, %t, %v, expected to capture order %s", retry, replayed, err, lost.OrderID)
+	}
+	// The lease of the dead request doesn't end the lease of the retry
+	ReleaseIdempotencyKey(ctx, lost)
+	if _, _, err := ClaimIdempotencyKey(ctx, "lost", body); err != ErrIdempotencyKeyInProgress {
+		t.Errorf("Claiming a key taken over returned %v, expected ErrIdempotencyKeyInProgress", err)
+	}
+
+	// A failed request releases its key for an immediate retry under the same id
+	ReleaseIdempotencyKey(ctx, retry)
+	again, replayed, err := ClaimIdempotencyKey(ctx, "lost", body)
+	if err != nil || replayed || again.OrderID != lost.OrderID {
+		t.Errorf("Retrying a released key returned %+v, %t, %v, expected to capture order %s", again, replayed, err, lost.OrderID)
+	}
+}
+
+func TestLateInsertOfAnAbandonedIdempotencyKey(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		defer func(store Store) { orderStore = store }(orderStore)
+		orderStore = store
+		defer func(lease time.Duration) { idempotencyLease = lease }(idempotencyLease)
+		idempotencyLease = time.Millisecond
+		ctx := context.Background()
+		body := []byte(`{"EmailAddress": "test@domain.com"}`)
+
+		// The first request stalls before its insert and a retry takes the key over
+		stalled, _, _ := ClaimIdempotencyKey(ctx, "late", body)
+		time.Sleep(5 * time.Millisecond)
+		idempotencyLease = time.Hour
+		retry, replayed, err := ClaimIdempotencyKey(ctx, "late", body)
+		if err != nil || replayed || retry.OrderID != stalled.OrderID {
+			t.Fatalf("Retrying a stalled order returned %+v, %t, %v, expected to capture order %s", retry, replayed, err, stalled.OrderID)
+		}
+
+		// The insert of the first request lands before the one of the retry
+		if _, err := AddOrderWithID(ctx, stalled.OrderID, Order{EmailAddress: "test@domain.com"}, ""); err != nil {
+			t.Fatalf("AddOrderWithID returned %v", err)
+		}
+		order, replayed, err := AddIdempotentOrder(ctx, retry, Order{EmailAddress: "test@domain.com"}, "")
+		if err != nil || !replayed || order.OrderID != stalled.OrderID {
+			t.Errorf("AddIdempotentOrder returned %+v, %t, %v, expected to replay order %s", order, replayed, err, stalled.OrderID)
+		}
+
+		orders, err := store.List(ctx, OrderFilter{}, "", 10)
+		if err != nil || len(orders) != 1 {
+			t.Errorf("List returned %d orders, %v, expected the order once", len(orders), err)
+		}
+	})
+}
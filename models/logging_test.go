@@ -0,0 +1,152 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"captureorderfd/logging"
+)
+
+func TestSecretsNeverAppearInLogs(t *testing.T) {
+	const (
+		insightsKey          = "0f1e2d3c-4b5a-6978-8796-a5b4c3d2e1f0"
+		challengeKey         = "a5b4c3d2-e1f0-0f1e-2d3c-4b5a69788796"
+		mongoPassword        = "Zm9vYmFyYmF6cXV4"
+		serviceBusKey        = "q8Gf1a+b/cDeFgHiJkLmNoPqRsTuVwXyZ0123456789="
+		connectionStringKey  = "c2VuZC1rZXktb2YtdGhlLXNlbmQtcG9saWN5"
+		encodedServiceBusKey = "q8Gf1a%2Bb%2FcDeFgHiJkLmNoPqRsTuVwXyZ0123456789%3D"
+	)
+
+	defer func(insights, challenge, mongo, amqp string) {
+		customInsightsKey, challengeInsightsKey, mongoURL, amqpURL = insights, challenge, mongo, amqp
+		logging.SetOutput(os.Stderr, logging.LevelInfo)
+	}(customInsightsKey, challengeInsightsKey, mongoURL, amqpURL)
+
+	customInsightsKey = insightsKey
+	challengeInsightsKey = challengeKey
+	mongoURL = "mongodb://orders:" + mongoPassword + "@orders.documents.azure.com:10255/?ssl=true"
+	amqpURL = "amqps://RootManageSharedAccessKey:" + encodedServiceBusKey + "@captureorder.servicebus.windows.net/orders"
+	connectionString := "Endpoint=sb://captureorder.servicebus.windows.net/;SharedAccessKeyName=send;SharedAccessKey=" + connectionStringKey + ";EntityPath=orders"
+
+	var out bytes.Buffer
+	logging.SetOutput(&out, logging.LevelDebug)
+	addSecrets()
+
+	// Startup
+	validateVariable(customInsightsKey, "APPINSIGHTS_KEY")
+	validateVariable(challengeInsightsKey, "CHALLENGEAPPINSIGHTS_KEY")
+	validateVariable(mongoURL, "MONGOURL")
+	validateVariable(amqpURL, "AMQPURL")
+	validateVariable(connectionString, "AMQPURL")
+	parsed, _ := url.Parse(mongoURL)
+	mongoDialInfo(parsed)
+	logging.Info("AMQP", "url", amqpURL)
+
+	// Free-form lines of the log package, and of the telemetry written to stdout
+	log.Println("Can't connect to", amqpURL, "or", connectionString, "with", serviceBusKey)
+	newJSONTelemetry(&out).TrackDependency(newDependency("ServiceBus", "AMQP", amqpURL, "Send OrderCreated", errors.New("detached"), time.Now(), time.Now()))
+	newJSONTelemetry(&out).TrackDependency(newDependency("CosmosDB", "MongoDB", mongoURL, "Insert order", nil, time.Now(), time.Now()))
+
+	logged := out.String()
+	for _, secret := range []string{insightsKey, challengeKey, mongoPassword, serviceBusKey, encodedServiceBusKey, connectionStringKey} {
+		if strings.Contains(logged, secret) {
+			t.Errorf("%s was logged:\n%s", secret, logged)
+		}
+	}
+	for _, kept := range []string{"orders.documents.azure.com", "captureorder.servicebus.windows.net", "SharedAccessKeyName=send", "APPINSIGHTS_KEY"} {
+		if !strings.Contains(logged, kept) {
+			t.Errorf("%s was masked too:\n%s", kept, logged)
+		}
+	}
+}
+
+func TestStartupLogsNoValues(t *testing.T) {
+	// Not registered as secrets, so only leaving them out keeps them from the logs
+	const value = "value-of-the-variable"
+	const password = "password-of-the-url"
+
+	var out bytes.Buffer
+	logging.SetOutput(&out, logging.LevelDebug)
+	defer logging.SetOutput(os.Stderr, logging.LevelInfo)
+
+	validateVariable(value, "SOME_VARIABLE")
+	parsed, _ := url.Parse("mongodb://orders:" + password + "@localhost:27017")
+	mongoDialInfo(parsed)
+
+	logged := out.String()
+	if strings.Contains(logged, value) || strings.Contains(logged, password) {
+		t.Errorf("A value was logged:\n%s", logged)
+	}
+	if !strings.Contains(logged, "SOME_VARIABLE") || !strings.Contains(logged, "localhost:27017") {
+		t.Errorf("The variable or the host is missing:\n%s", logged)
+	}
+}
+
+func TestRequestIDFollowsTheOrder(t *testing.T) {
+	const requestID = "5d0f3c2e-6c1b-4b7e-9a55-0d2f1e7c9a01"
+
+	var out bytes.Buffer
+	logging.SetOutput(&out, logging.LevelDebug)
+	defer logging.SetOutput(os.Stderr, logging.LevelInfo)
+
+	challenge, custom := &recordingTelemetry{}, &recordingTelemetry{}
+	challengeTelemetry, customTelemetry = challenge, custom
+	defer func() { challengeTelemetry, customTelemetry = noopTelemetry{}, noopTelemetry{} }()
+
+	orderStore = newMemoryStore()
+	publisher = newMemoryPublisher(1)
+	defer func() { publisher = nil }()
+
+	ctx := logging.WithRequestID(context.Background(), requestID)
+	TrackInitialOrder(ctx, Order{})
+	order, err := AddOrder(ctx, Order{EmailAddress: "private@domain.com"}, "")
+	if err != nil {
+		t.Fatalf("AddOrder returned %v", err)
+	}
+	relayOutbox()
+	msg := <-MemoryMessages()
+
+	if msg.Headers[logging.RequestIDHeader] != requestID {
+		t.Errorf("The message has headers %v, expected the request id", msg.Headers)
+	}
+
+	orderLines := 0
+	for _, text := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var line map[string]interface{}
+		if err := json.Unmarshal([]byte(text), &line); err != nil {
+			t.Fatalf("Line %q is not JSON: %v", text, err)
+		}
+		if line["orderId"] == order.OrderID {
+			orderLines++
+			if line["requestId"] != requestID {
+				t.Errorf("The line %q has no request id", text)
+			}
+		}
+	}
+	if orderLines < 2 {
+		t.Errorf("Expected the insert and the send to be logged:\n%s", out.String())
+	}
+	if strings.Contains(out.String(), "private@domain.com") {
+		t.Errorf("The email address was logged:\n%s", out.String())
+	}
+
+	if len(challenge.eventProperties) != 3 {
+		t.Fatalf("Tracked %d challenge events, expected 3", len(challenge.eventProperties))
+	}
+	for i, properties := range challenge.eventProperties {
+		if properties["requestId"] != requestID {
+			t.Errorf("The challenge event %s has properties %v, expected the request id", challenge.events[i], properties)
+		}
+	}
+	if len(custom.dependencies) != 1 || custom.dependencies[0].Properties["requestId"] != requestID {
+		t.Errorf("The send was tracked as %+v, expected the request id", custom.dependencies)
+	}
+}
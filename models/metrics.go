@@ -0,0 +1,133 @@
+package models
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gopkg.in/mgo.v2"
+)
+
+// Prometheus metrics of the capture pipeline, served by MetricsHandler
+var (
+	ordersReceived = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "captureorder_orders_received_total",
+		Help: "Orders posted, valid or not.",
+	})
+	validationFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "captureorder_validation_failures_total",
+		Help: "Request bodies rejected with 400, by reason: empty, json, invalid or idempotency_key.",
+	}, []string{"reason"})
+	storeDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "captureorder_store_duration_seconds",
+		Help:    "MongoDB/CosmosDB calls, by db and operation.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"db", "operation"})
+	storeErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "captureorder_store_errors_total",
+		Help: "Failed MongoDB/CosmosDB calls, by db and operation.",
+	}, []string{"db", "operation"})
+	publishDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "captureorder_publish_duration_seconds",
+		Help:    "AMQP publishes, confirmation included, by queue type.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"queue"})
+	publishErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "captureorder_publish_errors_total",
+		Help: "Failed AMQP publishes, by queue type.",
+	}, []string{"queue"})
+	retries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "captureorder_retries_total",
+		Help: "Attempts after the first one of the retry loops, by operation.",
+	}, []string{"operation"})
+	mongoPoolInUse = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "captureorder_mongo_pool_sockets_in_use",
+		Help: "MongoDB/CosmosDB sockets in use, at most captureorder_mongo_pool_limit.",
+	}, func() float64 {
+		return float64(mgo.GetStats().SocketsInUse)
+	})
+	mongoPoolLimitGauge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "captureorder_mongo_pool_limit",
+		Help: "MongoDB/CosmosDB pool limit, set with MONGOPOOL_LIMIT.",
+	}, func() float64 {
+		return float64(mongoPoolLimit)
+	})
+)
+
+// Validation failure reasons
+const (
+	ValidationEmpty          = "empty"
+	ValidationJSON           = "json"
+	ValidationInvalid        = "invalid"
+	ValidationIdempotencyKey = "idempotency_key"
+)
+
+// Retry loop operations
+const (
+	retryRabbitMQConnect   = "rabbitmq_connect"
+	retryServiceBusConnect = "servicebus_connect"
+	retryServiceBusSend    = "servicebus_send"
+)
+
+// The registry of the metrics, along with the Go runtime and process metrics
+var metricsRegistry = newMetricsRegistry()
+
+// newMetricsRegistry registers the metrics, and has mgo count the sockets in use for the pool usage
+func newMetricsRegistry() *prometheus.Registry {
+	mgo.SetStats(true)
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		ordersReceived,
+		validationFailures,
+		storeDuration,
+		storeErrors,
+		publishDuration,
+		publishErrors,
+		retries,
+		mongoPoolInUse,
+		mongoPoolLimitGauge,
+	)
+	return registry
+}
+
+// MetricsHandler Serves the metrics in the Prometheus text format
+func MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// CountOrderReceived Counts an order posted, before it is validated
+func CountOrderReceived() {
+	ordersReceived.Inc()
+}
+
+// CountValidationFailure Counts an order rejected because of the reason, one of the Validation constants
+func CountValidationFailure(reason string) {
+	validationFailures.WithLabelValues(reason).Inc()
+}
+
+// observeDependency records the latency and failure of a MongoDB/CosmosDB or AMQP call
+func observeDependency(dependency Dependency) {
+	seconds := dependency.End.Sub(dependency.Start).Seconds()
+	switch dependency.Type {
+	case "MongoDB":
+		storeDuration.WithLabelValues(dependency.Name, dependency.Data).Observe(seconds)
+		if !dependency.Success {
+			storeErrors.WithLabelValues(dependency.Name, dependency.Data).Inc()
+		}
+	case "AMQP":
+		publishDuration.WithLabelValues(dependency.Name).Observe(seconds)
+		if !dependency.Success {
+			publishErrors.WithLabelValues(dependency.Name).Inc()
+		}
+	}
+}
+
+// countRetry counts an attempt of a retry loop, the first one is not a retry
+func countRetry(operation string, attempt int) {
+	if attempt > 1 {
+		retries.WithLabelValues(operation).Inc()
+	}
+}
@@ -0,0 +1,60 @@
+package models
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestObserveDependency(t *testing.T) {
+	start := time.Now()
+	storeErrorsBefore := testutil.ToFloat64(storeErrors.WithLabelValues("MongoDB", "Insert order"))
+	publishErrorsBefore := testutil.ToFloat64(publishErrors.WithLabelValues("RabbitMQ"))
+
+	observeDependency(newDependency("MongoDB", "MongoDB", "mongodb://localhost", "Insert order", nil, start, start.Add(time.Millisecond)))
+	observeDependency(newDependency("MongoDB", "MongoDB", "mongodb://localhost", "Insert order", errors.New("E11000"), start, start.Add(time.Millisecond)))
+	observeDependency(newDependency("RabbitMQ", "AMQP", "amqp://localhost", "Send OrderCreated", errors.New("nacked"), start, start.Add(time.Millisecond)))
+
+	if errs := testutil.ToFloat64(storeErrors.WithLabelValues("MongoDB", "Insert order")) - storeErrorsBefore; errs != 1 {
+		t.Errorf("Counted %v store errors, expected 1", errs)
+	}
+	if errs := testutil.ToFloat64(publishErrors.WithLabelValues("RabbitMQ")) - publishErrorsBefore; errs != 1 {
+		t.Errorf("Counted %v publish errors, expected 1", errs)
+	}
+}
+
+func TestCountRetry(t *testing.T) {
+	before := testutil.ToFloat64(retries.WithLabelValues(retryRabbitMQConnect))
+	for attempt := 1; attempt <= 3; attempt++ {
+		countRetry(retryRabbitMQConnect, attempt)
+	}
+	if counted := testutil.ToFloat64(retries.WithLabelValues(retryRabbitMQConnect)) - before; counted != 2 {
+		t.Errorf("Counted %v retries of 3 attempts, expected 2", counted)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	CountOrderReceived()
+	CountValidationFailure(ValidationJSON)
+
+	recorder := httptest.NewRecorder()
+	MetricsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := ioutil.ReadAll(recorder.Body)
+
+	for _, metric := range []string{
+		"captureorder_orders_received_total",
+		`captureorder_validation_failures_total{reason="json"}`,
+		"captureorder_mongo_pool_sockets_in_use",
+		"captureorder_mongo_pool_limit 25",
+		"go_goroutines",
+	} {
+		if !strings.Contains(string(body), metric) {
+			t.Errorf("%s is not served:\n%s", metric, body)
+		}
+	}
+}
@@ -2,11 +2,9 @@ package models
 
 import (
 	"context"
-	"crypto/tls"
+	"errors"
 	"fmt"
-	"net"
-
-	"log"
+	"hash/fnv"
 	"math/rand"
 	"net/url"
 	"os"
@@ -14,24 +12,57 @@ import (
 	"strings"
 	"time"
 
-	"github.com/Microsoft/ApplicationInsights-Go/appinsights"
-	amqp091 "github.com/streadway/amqp"
-	"gopkg.in/matryer/try.v1"
-	"gopkg.in/mgo.v2"
+	"captureorderfd/logging"
+
 	"gopkg.in/mgo.v2/bson"
-	amqp10 "pack.ag/amqp"
 )
 
 // Order represents the order json
 type Order struct {
-	OrderID           string  `required:"false" description:"CosmoDB ID - will be autogenerated"`
-	EmailAddress      string  `required:"true" description:"Email address of the customer"`
-	PreferredLanguage string  `required:"false" description:"Preferred Language of the customer"`
-	Product           string  `required:"false" description:"Product ordered by the customer"`
-	Partition         string  `required:"false" description:"MongoDB Partition. Generated."`
-	Total             float64 `required:"false" description:"Order total"`
-	Source            string  `required:"false" description:"Source backend e.g. App Service, Container instance, K8 cluster etc"`
-	Status            string  `required:"true" description:"Order Status"`
+	OrderID           string             `required:"false" description:"CosmoDB ID - will be autogenerated"`
+	EmailAddress      string             `required:"true" maxLength:"254" format:"email" description:"Email address of the customer"`
+	PreferredLanguage string             `required:"false" maxLength:"35" format:"bcp47" description:"Preferred Language of the customer, a BCP 47 tag such as en-US"`
+	Product           string             `required:"false" maxLength:"100" description:"Product ordered by the customer"`
+	Partition         string             `required:"false" description:"MongoDB Partition. Generated."`
+	Total             float64            `required:"false" min:"0" description:"Order total"`
+	Source            string             `required:"false" maxLength:"100" description:"Source backend e.g. App Service, Container instance, K8 cluster etc"`
+	Status            string             `required:"false" description:"Order Status. Generated, always Open for a new order."`
+	StatusHistory     []StatusTransition `required:"false" description:"Status changes, oldest first. Generated."`
+	Outbox            []OutboxEvent      `json:"-"`
+}
+
+// ErrOrderNotFound is returned when no order matches the requested id
+var ErrOrderNotFound = errors.New("order not found")
+
+// ErrInvalidOrderID is returned when an order id is not a valid hex ObjectId
+var ErrInvalidOrderID = errors.New("invalid order id")
+
+// ErrInvalidCursor is returned when a page cursor was not issued by ListOrders
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Page sizes for ListOrders
+const (
+	DefaultOrderPageSize = 20
+	MaxOrderPageSize     = 100
+)
+
+// OrderFilter narrows down the orders returned by ListOrders.
+// Empty fields and zero times are ignored.
+type OrderFilter struct {
+	EmailAddress string
+	Status       string
+	Product      string
+	Source       string
+	Partition    string
+	CreatedFrom  time.Time // inclusive
+	CreatedTo    time.Time // exclusive
+}
+
+// OrderPage is a single page of orders. NextCursor is empty on the last page.
+type OrderPage struct {
+	Orders     []Order `json:"orders"`
+	Count      int     `json:"count"`
+	NextCursor string  `json:"nextCursor,omitempty"`
 }
 
 // Environment variables
@@ -40,156 +71,201 @@ var challengeInsightsKey = os.Getenv("CHALLENGEAPPINSIGHTS_KEY")
 var mongoURL = os.Getenv("MONGOURL")
 var amqpURL = os.Getenv("AMQPURL")
 var teamName = os.Getenv("TEAMNAME")
+var storeKind = os.Getenv("ORDER_STORE")
 var mongoPoolLimit = 25
+var logLevel = logging.LevelInfo
 
-// MongoDB variables
-var mongoDBSession *mgo.Session
-var mongoDBSessionError error
+// For tracking and code branching purposes
+var isServiceBus = strings.Contains(amqpURL, "servicebus.windows.net")
+var db string        // CosmosDB, MongoDB or Memory?
+var queueType string // ServiceBus, RabbitMQ, Memory or File
 
-// MongoDB database and collection names
-var mongoDatabaseName = "k8orders"
-var mongoCollectionName = "orders"
-var mongoCollectionShardKey = "partition"
+// TrackInitialOrder Tracks the order received for the challenge, with the request id of ctx if any
+func TrackInitialOrder(ctx context.Context, order Order) {
+	trackChallengeEvent(ctx, "Initial order", "0", "http", order.OrderID)
+}
 
-// AMQP 0.9.1 variables
-var amqp091Client *amqp091.Connection
-var amqp091Channel *amqp091.Channel
-var amqp091Queue amqp091.Queue
+// AddOrder Adds the order to the OrderStore (MongoDB/CosmosDB unless ORDER_STORE says otherwise).
+// The correlation id, if any, and the trace and request id of ctx are passed on to the OrderCreated event.
+func AddOrder(ctx context.Context, order Order, correlationID string) (Order, error) {
+	return AddOrderWithID(ctx, bson.NewObjectId().Hex(), order, correlationID)
+}
 
-// AMQP 1.0 variables
-var amqp10Client *amqp10.Client
-var amqp10Session *amqp10.Session
-var amqpSender *amqp10.Sender
-var serivceBusName string
+// AddOrderWithID Adds the order under an id chosen beforehand, such as the one of a claimed Idempotency-Key.
+// It returns ErrDuplicateOrder if an order with that id exists.
+func AddOrderWithID(ctx context.Context, orderID string, order Order, correlationID string) (Order, error) {
+	success := false
+	logger := logging.FromContext(ctx)
 
-// Application Insights telemetry clients
-var challengeTelemetryClient appinsights.TelemetryClient
-var customTelemetryClient appinsights.TelemetryClient
+	order.OrderID = orderID
+	order.Partition = orderPartition(orderID)
 
-// For tracking and code branching purposes
-var isCosmosDb = strings.Contains(mongoURL, "documents.azure.com")
-var isServiceBus = strings.Contains(amqpURL, "servicebus.windows.net")
-var db string        // CosmosDB or MongoDB?
-var queueType string // ServiceBus or RabbitMQ
-
-func TrackInitialOrder(order Order) {
-	eventTelemetry := appinsights.NewEventTelemetry("Initial order")
-	eventTelemetry.Properties["team"] = teamName
-	eventTelemetry.Properties["sequence"] = "0"
-	eventTelemetry.Properties["type"] = "http"
-	eventTelemetry.Properties["service"] = "CaptureOrder"
-	eventTelemetry.Properties["orderId"] = order.OrderID
-	challengeTelemetryClient.Track(eventTelemetry)
-	if customTelemetryClient != nil {
-		customTelemetryClient.Track(eventTelemetry)
+	order.Status = StatusOpen
+	order.StatusHistory = []StatusTransition{{To: StatusOpen, At: time.Now().UTC()}}
+	if order.Source == "" || order.Source == "string" {
+		order.Source = os.Getenv("SOURCE")
 	}
-}
 
-// AddOrderToMongoDB Adds the order to MongoDB/CosmosDB
-func AddOrderToMongoDB(order Order) (Order, error) {
-	success := false
-	startTime := time.Now()
+	// The announcement is stored with the order and published by the outbox relay
+	order.Outbox = []OutboxEvent{newOrderCreatedEvent(order, correlationID)}
+	order.Outbox[0].TraceContext = injectTraceContext(ctx)
+	order.Outbox[0].RequestID = logging.RequestID(ctx)
+
+	_, span := startStoreSpan(ctx, "Insert order")
+	err := orderStore.Create(ctx, order)
+	endSpan(span, err)
+	if err == ErrDuplicateOrder {
+		logger.Warn("The order exists already", "orderId", order.OrderID)
+	} else if err != nil {
+		telemetryFor(ctx, customTelemetry).TrackException(err, nil)
+		logger.Error("Problem inserting the order", "orderId", order.OrderID, "error", err)
+	} else {
+		success = true
+		logger.Info("Inserted order", "orderId", order.OrderID, "team", teamName, "partition", order.Partition)
+	}
 
-	// Use the existing mongoDBSessionCopy
-	mongoDBSessionCopy := mongoDBSession.Copy()
-	defer mongoDBSessionCopy.Close()
+	if success {
+		// Track the event for the challenge purposes
+		telemetryFor(ctx, challengeTelemetry).TrackEvent("CaptureOrder to "+db, challengeEventProperties("1", db, order.OrderID))
 
-	log.Println("Team " + teamName)
+		notifyOutbox()
+	}
 
-	// Select a random partition
-	rand.Seed(time.Now().UnixNano())
-	partitionKey := strconv.Itoa(random(0, 11))
-	order.Partition = fmt.Sprintf("partition-%s", partitionKey)
+	return order, err
+}
 
-	NewOrderID := bson.NewObjectId()
-	order.OrderID = NewOrderID.Hex()
+// GetOrder Gets an order from the OrderStore by its hex ObjectId
+func GetOrder(ctx context.Context, orderID string) (Order, error) {
+	if !bson.IsObjectIdHex(orderID) {
+		return Order{}, ErrInvalidOrderID
+	}
 
-	order.Status = "Open"
-	if order.Source == "" || order.Source == "string" {
-		order.Source = os.Getenv("SOURCE")
+	order, err := orderStore.Get(ctx, orderID)
+	if err != nil && err != ErrOrderNotFound {
+		trackException(ctx, err)
+		logging.FromContext(ctx).Error("Problem reading the order", "orderId", orderID, "error", err)
 	}
+	return order, err
+}
 
-	log.Print("Inserting into MongoDB URL: ", mongoURL, " CosmosDB: ", isCosmosDb)
+// ListOrders Lists orders from the OrderStore, oldest first.
+// Pages are keyed on the order ObjectId, pass the NextCursor of the previous page to get the next one.
+func ListOrders(ctx context.Context, filter OrderFilter, cursor string, limit int) (OrderPage, error) {
+	page := OrderPage{Orders: []Order{}}
 
-	// insert Document in collection
-	mongoDBCollection := mongoDBSessionCopy.DB(mongoDatabaseName).C(mongoCollectionName)
-	mongoDBSessionError = mongoDBCollection.Insert(order)
-	log.Println("Inserted order:", order)
+	if cursor != "" && !bson.IsObjectIdHex(cursor) {
+		return page, ErrInvalidCursor
+	}
 
-	if mongoDBSessionError != nil {
-		// If the team provided an Application Insights key, let's track that exception
-		if customTelemetryClient != nil {
-			customTelemetryClient.TrackException(mongoDBSessionError)
-		}
-		log.Println("Problem inserting data: ", mongoDBSessionError)
-		log.Println("_id:", order)
-	} else {
-		success = true
+	if limit <= 0 {
+		limit = DefaultOrderPageSize
+	} else if limit > MaxOrderPageSize {
+		limit = MaxOrderPageSize
+	}
+
+	// Fetch one extra order to find out whether there is a next page
+	orders, err := orderStore.List(ctx, filter, cursor, limit+1)
+	if err != nil {
+		trackException(ctx, err)
+		logging.FromContext(ctx).Error("Problem listing orders", "error", err)
+		return page, err
 	}
 
-	endTime := time.Now()
+	if len(orders) > limit {
+		orders = orders[:limit]
+		page.NextCursor = orders[limit-1].OrderID
+	}
+	page.Orders = orders
+	page.Count = len(orders)
 
-	if success {
-		// Track the event for the challenge purposes
-		eventTelemetry := appinsights.NewEventTelemetry("CaptureOrder to " + db)
-		eventTelemetry.Properties["team"] = teamName
-		eventTelemetry.Properties["sequence"] = "1"
-		eventTelemetry.Properties["type"] = db
-		eventTelemetry.Properties["service"] = "CaptureOrder"
-		eventTelemetry.Properties["orderId"] = order.OrderID
-		challengeTelemetryClient.Track(eventTelemetry)
+	return page, nil
+}
+
+// UpdateOrderStatus Moves an order to a new status in the OrderStore and records the transition.
+// On ErrInvalidTransition the returned order holds the current status.
+// The correlation id, if any, and the request id of ctx are passed on to the OrderStatusChanged event.
+func UpdateOrderStatus(ctx context.Context, orderID string, status string, reason string, correlationID string) (Order, StatusTransition, error) {
+	var transition StatusTransition
+	if !IsValidStatus(status) {
+		return Order{}, transition, ErrInvalidStatus
 	}
 
-	// Track the dependency, if the team provided an Application Insights key, let's track that dependency
-	if customTelemetryClient != nil {
-		if isCosmosDb {
-			dependency := appinsights.NewRemoteDependencyTelemetry(
-				"CosmosDB",
-				"MongoDB",
-				mongoURL,
-				success)
-			dependency.Data = "Insert order"
-
-			if mongoDBSessionError != nil {
-				dependency.ResultCode = mongoDBSessionError.Error()
-			}
+	order, err := GetOrder(ctx, orderID)
+	if err != nil {
+		return order, transition, err
+	}
 
-			dependency.MarkTime(startTime, endTime)
-			customTelemetryClient.Track(dependency)
-		} else {
-			dependency := appinsights.NewRemoteDependencyTelemetry(
-				"MongoDB",
-				"MongoDB",
-				mongoURL,
-				success)
-			dependency.Data = "Insert order"
-
-			if mongoDBSessionError != nil {
-				dependency.ResultCode = mongoDBSessionError.Error()
-			}
+	if !CanTransition(order.Status, status) {
+		return order, transition, ErrInvalidTransition
+	}
 
-			dependency.MarkTime(startTime, endTime)
-			customTelemetryClient.Track(dependency)
+	transition = StatusTransition{
+		From:   order.Status,
+		To:     status,
+		Reason: reason,
+		At:     time.Now().UTC(),
+	}
+
+	updated := copyOrder(order)
+	updated.Status = transition.To
+	updated.StatusHistory = append(updated.StatusHistory, transition)
+
+	// The announcement is stored with the new status and published by the outbox relay
+	event := newStatusChangedEvent(updated, transition, correlationID)
+	event.RequestID = logging.RequestID(ctx)
+	err = orderStore.UpdateStatus(ctx, orderID, transition, event)
+	if err == ErrInvalidTransition {
+		// The status changed under us, report what it is now
+		current, getErr := GetOrder(ctx, orderID)
+		if getErr != nil {
+			return order, transition, getErr
+		}
+		return current, transition, err
+	}
+	if err != nil {
+		if err != ErrOrderNotFound {
+			trackException(ctx, err)
+			logging.FromContext(ctx).Error("Problem updating the status of the order", "orderId", orderID, "error", err)
 		}
+		return order, transition, err
 	}
 
-	return order, mongoDBSessionError
+	notifyOutbox()
+
+	return updated, transition, nil
 }
 
-// AddOrderToAMQP Adds the order to AMQP (EventHub/RabbitMQ)
-func AddOrderToAMQP(order Order) {
-	if isServiceBus {
-		addOrderToAMQP10(order)
-	} else {
-		addOrderToAMQP091(order)
+// DeleteOrder Removes an order from the OrderStore
+func DeleteOrder(ctx context.Context, orderID string) error {
+	if !bson.IsObjectIdHex(orderID) {
+		return ErrInvalidOrderID
 	}
+
+	err := orderStore.Delete(ctx, orderID)
+	if err != nil && err != ErrOrderNotFound {
+		trackException(ctx, err)
+		logging.FromContext(ctx).Error("Problem deleting the order", "orderId", orderID, "error", err)
+	}
+	return err
 }
 
-//// BEGIN: NON EXPORTED FUNCTIONS
-func init() {
+// Init Sets everything up like Setup and starts the outbox relay. Call it once before capturing orders.
+func Init() {
+	Setup()
+
+	// Start publishing the outbox
+	initOutbox()
+}
+
+// Setup Connects to the OrderStore and AMQP and sets up telemetry and dead lettering, without starting the outbox relay
+func Setup() {
 
 	rand.Seed(time.Now().UnixNano())
 
+	// Log JSON lines at LOG_LEVEL and above, masking the secrets of the environment variables
+	initLogging()
+	addSecrets()
+
 	// Validate environment variables
 	validateVariable(customInsightsKey, "APPINSIGHTS_KEY")
 	validateVariable(challengeInsightsKey, "CHALLENGEAPPINSIGHTS_KEY")
@@ -203,477 +279,151 @@ func init() {
 			mongoPoolLimit = limit
 		}
 	}
-	log.Printf("MongoDB pool limit set to %v. You can override by setting the MONGOPOOL_LIMIT environment variable.", mongoPoolLimit)
-
-	// Initialize the Application Insights telemtry client(s)
-	challengeTelemetryClient = appinsights.NewTelemetryClient(challengeInsightsKey)
-	challengeTelemetryClient.Context().Tags.Cloud().SetRole("captureorder_golang")
-
-	if customInsightsKey != "" {
-		customTelemetryClient = appinsights.NewTelemetryClient(customInsightsKey)
-
-		// Set role instance name globally -- this is usually the
-		// name of the service submitting the telemetry
-		customTelemetryClient.Context().Tags.Cloud().SetRole("captureorder_golang")
-	}
-
-	// Initialize the MongoDB client
-	initMongo()
-
-	// Initialize the AMQP client
-	initAMQP()
-}
-
-// Logs out value of a variable
-func validateVariable(value string, envName string) {
-	if len(value) == 0 {
-		log.Printf("The environment variable %s has not been set", envName)
-	} else {
-		log.Printf("The environment variable %s is %s", envName, value)
-	}
-}
+	logging.Info("MongoDB pool limit set. You can override by setting the MONGOPOOL_LIMIT environment variable.", "limit", mongoPoolLimit)
 
-func initMongoDial() (success bool, mErr error) {
-	url, err := url.Parse(mongoURL)
-	if err != nil {
-		// If the team provided an Application Insights key, let's track that exception
-		if customTelemetryClient != nil {
-			customTelemetryClient.TrackException(err)
+	var idempotencyWindowEnv = os.Getenv("IDEMPOTENCY_WINDOW")
+	if idempotencyWindowEnv != "" {
+		if window, err := time.ParseDuration(idempotencyWindowEnv); err == nil && window > 0 {
+			idempotencyWindow = window
 		}
-		log.Fatal(fmt.Sprintf("Problem parsing Mongo URL %s: ", url), err)
-	}
-
-	if isCosmosDb {
-		log.Println("Using CosmosDB")
-		db = "CosmosDB"
-
-	} else {
-		log.Println("Using MongoDB")
-		db = "MongoDB"
 	}
+	logging.Info("Idempotency window set. You can override by setting the IDEMPOTENCY_WINDOW environment variable.", "window", idempotencyWindow)
 
-	// Parse the connection string to extract components because the MongoDB driver is peculiar
-	var dialInfo *mgo.DialInfo
-	mongoUsername := ""
-	mongoPassword := ""
-	if url.User != nil {
-		mongoUsername = url.User.Username()
-		mongoPassword, _ = url.User.Password()
-	}
-	mongoHost := url.Host
-	mongoDatabase := mongoDatabaseName // can be anything
-	mongoSSL := strings.Contains(url.RawQuery, "ssl=true")
-
-	log.Printf("\tUsername: %s", mongoUsername)
-	log.Printf("\tPassword: %s", mongoPassword)
-	log.Printf("\tHost: %s", mongoHost)
-	log.Printf("\tDatabase: %s", mongoDatabase)
-	log.Printf("\tSSL: %t", mongoSSL)
-
-	if mongoSSL {
-		dialInfo = &mgo.DialInfo{
-			Addrs:    []string{mongoHost},
-			Timeout:  10 * time.Second,
-			Database: mongoDatabase, // It can be anything
-			Username: mongoUsername, // Username
-			Password: mongoPassword, // Password
-			DialServer: func(addr *mgo.ServerAddr) (net.Conn, error) {
-				return tls.Dial("tcp", addr.String(), &tls.Config{})
-			},
-		}
-	} else {
-		dialInfo = &mgo.DialInfo{
-			Addrs:    []string{mongoHost},
-			Timeout:  10 * time.Second,
-			Database: mongoDatabase, // It can be anything
-			Username: mongoUsername, // Username
-			Password: mongoPassword, // Password
+	var idempotencyLeaseEnv = os.Getenv("IDEMPOTENCY_LEASE")
+	if idempotencyLeaseEnv != "" {
+		if lease, err := time.ParseDuration(idempotencyLeaseEnv); err == nil && lease > 0 {
+			idempotencyLease = lease
 		}
 	}
+	logging.Info("Idempotency lease set. You can override by setting the IDEMPOTENCY_LEASE environment variable.", "lease", idempotencyLease)
 
-	// Create a mongoDBSession which maintains a pool of socket connections
-	// to our MongoDB.
-	success = false
-	startTime := time.Now()
-
-	log.Println("Attempting to connect to MongoDB")
-	mongoDBSession, mongoDBSessionError = mgo.DialWithInfo(dialInfo)
-	if mongoDBSessionError != nil {
-		log.Println(fmt.Sprintf("Can't connect to mongo at [%s], go error: ", mongoURL), mongoDBSessionError)
-		if customTelemetryClient != nil {
-			customTelemetryClient.TrackException(mongoDBSessionError)
-		}
-		mErr = mongoDBSessionError
-	} else {
-		success = true
-		log.Println("\tConnected")
+	if format := strings.ToLower(os.Getenv("EVENT_FORMAT")); isEventFormat(format) {
+		eventFormat = format
+	} else if format != "" {
+		logging.Warn("Unknown EVENT_FORMAT, use "+EventFormatEnvelope+", "+EventFormatLegacy+", "+EventFormatCloudEvents+" or "+EventFormatCloudEventsBinary, "format", format)
 	}
+	logging.Info("Publishing events. You can override by setting the EVENT_FORMAT environment variable to "+EventFormatEnvelope+", "+EventFormatLegacy+", "+EventFormatCloudEvents+" or "+EventFormatCloudEventsBinary+".", "format", eventFormat)
 
-	mongoDBSession.SetMode(mgo.Monotonic, true)
+	// Initialize the challenge and custom telemetry
+	initTelemetry()
+	initTracing()
 
-	// Limit connection pool to avoid running into Request Rate Too Large on CosmosDB
-	mongoDBSession.SetPoolLimit(mongoPoolLimit)
+	// Read the keys of the admin API
+	initAdmin()
 
-	endTime := time.Now()
+	// Initialize the OrderStore, MongoDB unless ORDER_STORE says otherwise
+	if err := UseStore(storeKind); err != nil {
+		logging.Fatal("Couldn't initialize the order store", "error", err)
+	}
+	logging.Info("Storing orders. You can override by setting the ORDER_STORE environment variable to "+StoreMongoDB+" or "+StoreMemory+".", "db", db)
 
-	// Track the dependency, if the team provided an Application Insights key, let's track that dependency
-	if customTelemetryClient != nil {
-		if isCosmosDb {
-			dependency := appinsights.NewRemoteDependencyTelemetry(
-				"CosmosDB",
-				"MongoDB",
-				mongoURL,
-				success)
-			dependency.Data = "Create session"
+	// Initialize the AMQP client
+	initAMQP()
 
-			if mongoDBSessionError != nil {
-				dependency.ResultCode = mongoDBSessionError.Error()
-			}
+	// Initialize the dead letter sink, which may use the AMQP client
+	initDeadLetters()
+}
 
-			dependency.MarkTime(startTime, endTime)
-			customTelemetryClient.TrackException(mongoDBSessionError)
-			customTelemetryClient.Track(dependency)
-		} else {
-			dependency := appinsights.NewRemoteDependencyTelemetry(
-				"MongoDB",
-				"MongoDB",
-				mongoURL,
-				success)
-			dependency.Data = "Create session"
-
-			if mongoDBSessionError != nil {
-				dependency.ResultCode = mongoDBSessionError.Error()
-			}
+//// BEGIN: NON EXPORTED FUNCTIONS
 
-			dependency.MarkTime(startTime, endTime)
-			customTelemetryClient.TrackException(mongoDBSessionError)
-			customTelemetryClient.Track(dependency)
-		}
+// Logs out whether a variable is set, not its value
+func validateVariable(value string, envName string) {
+	if len(value) == 0 {
+		logging.Warn("The environment variable has not been set", "name", envName)
+	} else {
+		logging.Info("The environment variable is set", "name", envName)
 	}
-	return
 }
 
-// Initialize the MongoDB client
-func initMongo() {
-
-	success, err := initMongoDial()
-	if !success {
-		os.Exit(1)
+// initLogging writes JSON lines to stderr, at LOG_LEVEL and above
+func initLogging() {
+	if level, err := logging.ParseLevel(os.Getenv("LOG_LEVEL")); err == nil {
+		logLevel = level
 	}
+	logging.SetOutput(os.Stderr, logLevel)
+	logging.Info("Log level set. You can override by setting the LOG_LEVEL environment variable to debug, info, warn or error.", "level", logLevel.String())
+}
 
-	mongoDBSessionCopy := mongoDBSession.Copy()
-	defer mongoDBSessionCopy.Close()
-
-	// SetSafe changes the mongoDBSessionCopy safety mode.
-	// If the safe parameter is nil, the mongoDBSessionCopy is put in unsafe mode, and writes become fire-and-forget,
-	// without error checking. The unsafe mode is faster since operations won't hold on waiting for a confirmation.
-	// http://godoc.org/labix.org/v2/mgo#Session.SetMode.
-	mongoDBSessionCopy.SetSafe(nil)
-
-	// Create a sharded collection and retrieve it
-	result := bson.M{}
-	err = mongoDBSessionCopy.DB(mongoDatabaseName).Run(
-		bson.D{
-			{
-				"shardCollection",
-				fmt.Sprintf("%s.%s", mongoDatabaseName, mongoCollectionName),
-			},
-			{
-				"key",
-				bson.M{
-					mongoCollectionShardKey: "hashed",
-				},
-			},
-		}, &result)
-
-	if err != nil {
-		trackException(err)
-		// The collection is most likely created and already sharded. I couldn't find a more elegant way to check this.
-		log.Println("Could not create/re-create sharded MongoDB collection. Either collection is already sharded or sharding is not supported. You can ignore this error: ", err)
-	} else {
-		log.Println("Created MongoDB collection: ")
-		log.Println(result)
+// addSecrets masks the Application Insights keys, the admin key and the passwords of the MongoDB and AMQP URLs in the logs
+func addSecrets() {
+	logging.AddSecret(customInsightsKey)
+	logging.AddSecret(challengeInsightsKey)
+	logging.AddSecret(os.Getenv("ADMIN_KEY"))
+	for _, rawURL := range []string{mongoURL, amqpURL} {
+		if u, err := url.Parse(rawURL); err == nil && u.User != nil {
+			if password, ok := u.User.Password(); ok {
+				logging.AddSecret(password)
+			}
+		}
 	}
 }
 
 // Initalize AMQP by figuring out where we are running
 func initAMQP() {
-	url, err := url.Parse(amqpURL)
-	if err != nil {
-		// If the team provided an Application Insights key, let's track that exception
-		trackException(err)
-		log.Fatal(fmt.Sprintf("Problem parsing AMQP Host %s. Make sure you URL Encoded your policy/password.", url), err)
+	if timeout, err := time.ParseDuration(os.Getenv("AMQP_CONFIRM_TIMEOUT")); err == nil && timeout > 0 {
+		amqpConfirmTimeout = timeout
 	}
-
-	// Figure out if we're running on ServiceBus or elsewhere
-	if isServiceBus {
-		log.Println("Using ServiceBus")
-		queueType = "ServiceBus"
-
-		// Parse the ServiceBus (last part of the url)
-		serivceBusName = url.Path
-		initAMQP10()
-	} else {
-		log.Println("Using RabbitMQ")
-		queueType = "RabbitMQ"
-		initAMQP091()
+	serviceBusKeyFile = os.Getenv("SERVICEBUS_KEY_FILE")
+	if reload, err := time.ParseDuration(os.Getenv("SERVICEBUS_KEY_RELOAD")); err == nil && reload > 0 {
+		serviceBusKeyReload = reload
 	}
-	log.Println("\tAMQP URL: " + amqpURL)
-	log.Println("** READY TO TAKE ORDERS **")
-}
-
-func initAMQP091() {
-	log.Println("Attempting to connect to RabbitMQ")
-	// Try to establish the connection to AMQP
-	// with retry logic
-	err := try.Do(func(attempt int) (bool, error) {
-		var err error
-
-		amqp091Client, err = amqp091.Dial(amqpURL)
-		if err != nil {
-			// If the team provided an Application Insights key, let's track that exception
-			if customTelemetryClient != nil {
-				customTelemetryClient.TrackException(err)
-			}
-		}
 
-		if err != nil {
-			log.Println("Error connecting to Rabbit instance. Will retry in 5 seconds:", err)
-			time.Sleep(5 * time.Second) // wait
-		}
-		return attempt < 3, err
-	})
-
-	// If we still can't connect
+	var err error
+	publisher, queueType, err = newPublisher(amqpURL)
 	if err != nil {
-		log.Println("Couldn't connect to Rabbit after 3 retries:", err)
+		// If the team provided an Application Insights key, let's track that exception
+		trackException(context.Background(), err)
+		logging.Error("Problem connecting to AMQP. Check the AMQPURL, or the Service Bus connection string.", "error", err)
+		publisher = nil
 	} else {
-		log.Println("\tConnected to RabbitMQ. Establishing Channel and Queue")
-
-		// Otherwise, let's continue and establish the channel and queue
-		amqp091Channel, err = amqp091Client.Channel()
-		if err != nil {
-			// If the team provided an Application Insights key, let's track that exception
-			if customTelemetryClient != nil {
-				customTelemetryClient.TrackException(err)
-			}
-		}
-
-		amqp091Queue, err = amqp091Channel.QueueDeclare(
-			"order", // name
-			true,    // durable
-			false,   // delete when unused
-			false,   // exclusive
-			false,   // no-wait
-			nil,     // arguments
-		)
+		logging.Info("Using "+queueType, "url", amqpURL)
 	}
+	logging.Info("** READY TO TAKE ORDERS **")
 }
 
-func initAMQP10() {
-
-	// Try to establish the connection to AMQP
-	// with retry logic
-	err := try.Do(func(attempt int) (bool, error) {
-		var err error
-
-		log.Println("Attempting to connect to ServiceBus")
-		amqp10Client, err = amqp10.Dial(amqpURL)
-		if err != nil {
-			// If the team provided an Application Insights key, let's track that exception
-			trackException(err)
-		}
-		//defer amqp10Client.Close()
-
-		// Open a session if we managed to get an amqpClient
-		log.Println("\tConnected to ServiceBus")
-		if amqp10Client != nil {
-			log.Println("\tCreating a new AMQP session")
-			amqp10Session, err = amqp10Client.NewSession()
-			if err != nil {
-				// If the team provided an Application Insights key, let's track that exception
-				trackException(err)
-				log.Fatal("\t\tCreating AMQP session: ", err)
-			}
-		}
-
-		// Create a sender
-		log.Println("\tCreating AMQP sender")
-		amqpSender, err = amqp10Session.NewSender(
-			amqp10.LinkTargetAddress(serivceBusName),
-		)
-		if err != nil {
-			// If the team provided an Application Insights key, let's track that exception
-			if customTelemetryClient != nil {
-				customTelemetryClient.TrackException(err)
-			}
-			log.Fatal("\t\tCreating sender link: ", err)
-		}
-
-		if err != nil {
-			log.Println("Error connecting to ServiceBus instance. Will retry in 5 seconds:", err)
-			time.Sleep(5 * time.Second) // wait
-		}
-		return attempt < 3, err
-	})
-
-	// If we still can't connect
-	if err != nil {
-		log.Println("Couldn't connect to ServiceBus after 3 retries:", err)
+// sendOrderEvent returns the challenge telemetry event name and type for the queue in use
+func sendOrderEvent() (string, string) {
+	switch queueType {
+	case QueueServiceBus:
+		return "SendOrder to SerivceBus", "servicebus"
+	case QueueRabbitMQ:
+		return "SendOrder to RabbitMQ", "rabbitmq"
 	}
+	return "SendOrder to " + queueType, strings.ToLower(queueType)
 }
 
-// addOrderToAMQP091 Adds the order to AMQP 0.9.1
-func addOrderToAMQP091(order Order) {
-	if amqp091Channel == nil {
-		log.Println("Skipping AMQP. It is either not configured or improperly configured")
-	} else {
-		success := false
-		startTime := time.Now()
-		body := fmt.Sprintf("{\"order\": \"%s\", \"source\": \"%s\"}", order.OrderID, teamName)
-
-		// Send message
-		err := amqp091Channel.Publish(
-			"",                // exchange
-			amqp091Queue.Name, // routing key
-			false,             // mandatory
-			false,             // immediate
-			amqp091.Publishing{
-				DeliveryMode: amqp091.Persistent,
-				ContentType:  "application/json",
-				Body:         []byte(body),
-			})
-		if err != nil {
-			// If the team provided an Application Insights key, let's track that exception
-			trackException(err)
-			log.Println("Sending message:", err)
-		} else {
-			success = true
-		}
-
-		endTime := time.Now()
-
-		if success {
-			// Track the event for the challenge purposes
-			eventTelemetry := appinsights.NewEventTelemetry("SendOrder to RabbitMQ")
-			eventTelemetry.Properties["team"] = teamName
-			eventTelemetry.Properties["sequence"] = "2"
-			eventTelemetry.Properties["type"] = "rabbitmq"
-			eventTelemetry.Properties["service"] = "CaptureOrder"
-			eventTelemetry.Properties["orderId"] = order.OrderID
-			challengeTelemetryClient.Track(eventTelemetry)
-			if customTelemetryClient != nil {
-				customTelemetryClient.Track(eventTelemetry)
-			}
-		}
-
-		// Track the dependency, if the team provided an Application Insights key, let's track that dependency
-		if customTelemetryClient != nil {
-			dependency := appinsights.NewRemoteDependencyTelemetry(
-				"RabbitMQ",
-				"AMQP",
-				amqpURL,
-				success)
-			dependency.Data = "Send message"
-
-			if err != nil {
-				dependency.ResultCode = err.Error()
-			}
-
-			dependency.MarkTime(startTime, endTime)
-			customTelemetryClient.Track(dependency)
-		}
-
-		log.Printf("Sent to AMQP 0.9.1 (RabbitMQ) - %t, %s: %s", success, amqpURL, body)
+// trackSendOrderEvent tracks the challenge event of a sent order.
+// Like the capture in MongoDB, the Service Bus send only goes to the challenge telemetry.
+func trackSendOrderEvent(ctx context.Context, orderID string) {
+	eventName, eventType := sendOrderEvent()
+	if queueType == QueueServiceBus {
+		telemetryFor(ctx, challengeTelemetry).TrackEvent(eventName, challengeEventProperties("2", eventType, orderID))
+		return
 	}
+	trackChallengeEvent(ctx, eventName, "2", eventType, orderID)
 }
 
-// addOrderToAMQP10 Adds the order to AMQP 1.0 (sends to the Default ConsumerGroup)
-func addOrderToAMQP10(order Order) {
-	if amqp10Client == nil {
-		log.Println("Skipping AMQP. It is either not configured or improperly configured")
-	} else {
-		// Only run this part if AMQP is configured
-		success := false
-		var err error
-		startTime := time.Now()
-		body := fmt.Sprintf("{\"order\": \"%s\", \"source\": \"%s\"}", order.OrderID, teamName)
-
-		// Get an empty context
-		amqp10Context := context.Background()
-
-		log.Printf("AMQP URL: %s, Target: %s", amqpURL, serivceBusName)
-
-		// Prepare the context to timeout in 5 seconds
-		amqp10Context, cancel := context.WithTimeout(amqp10Context, 5*time.Second)
-
-		// Send with retry logic (in case we get a amqp.DetachError)
-		err = try.Do(func(attempt int) (bool, error) {
-			var err error
-
-			log.Println("Attempting to send the AMQP message: ", body)
-			err = amqpSender.Send(amqp10Context, amqp10.NewMessage([]byte(body)))
-			if err != nil {
-				trackException(err)
-				initAMQP10()
-			}
-			return attempt < 3, err
-		})
-
-		// Now check after possible retries if the message was sent
-		success = (err == nil)
-
-		// Cancel the context and close the sender
-		cancel()
-		//sender.Close()
-
-		endTime := time.Now()
-
-		if success {
-			// Track the event for the challenge purposes
-			eventTelemetry := appinsights.NewEventTelemetry("SendOrder to SerivceBus")
-			eventTelemetry.Properties["team"] = teamName
-			eventTelemetry.Properties["sequence"] = "2"
-			eventTelemetry.Properties["type"] = "servicebus"
-			eventTelemetry.Properties["service"] = "CaptureOrder"
-			eventTelemetry.Properties["orderId"] = order.OrderID
-			challengeTelemetryClient.Track(eventTelemetry)
-		}
-
-		// Track the dependency, if the team provided an Application Insights key, let's track that dependency
-		if customTelemetryClient != nil {
-			dependency := appinsights.NewRemoteDependencyTelemetry(
-				"ServiceBus",
-				"AMQP",
-				amqpURL,
-				success)
-			dependency.Data = "Send message"
-
-			if err != nil {
-				dependency.ResultCode = err.Error()
-			}
-
-			dependency.MarkTime(startTime, endTime)
-			customTelemetryClient.Track(dependency)
-		}
-
-		log.Printf("Sent to AMQP 1.0 (ServiceBus) - %t, %s: %s", success, amqpURL, body)
-	}
+// trackAMQPDependency tracks an AMQP call in the custom telemetry, with the request id of ctx if any, and the metrics
+func trackAMQPDependency(ctx context.Context, data string, err error, startTime time.Time, endTime time.Time) {
+	dependency := newDependency(queueType, "AMQP", amqpURL, data, err, startTime, endTime)
+	telemetryFor(ctx, customTelemetry).TrackDependency(dependency)
+	observeDependency(dependency)
 }
 
-func trackException(err error) {
+// trackException tracks the error in the challenge and the custom telemetry, with the request id of ctx if any
+func trackException(ctx context.Context, err error) {
 	if err != nil {
-		log.Println(err)
-		challengeTelemetryClient.TrackException(err)
-		if customTelemetryClient != nil {
-			customTelemetryClient.TrackException(err)
-		}
+		telemetryFor(ctx, challengeTelemetry).TrackException(err, nil)
+		telemetryFor(ctx, customTelemetry).TrackException(err, nil)
 	}
 }
 
-// random: Generates a random number
-func random(min int, max int) int {
-	return rand.Intn(max-min) + min
+// orderPartition Spreads the orders over 11 partitions by their id, so an order id always maps to the same
+// partition and the unique index on the partition and the order id rejects a second order with that id
+func orderPartition(orderID string) string {
+	hash := fnv.New32a()
+	hash.Write([]byte(orderID))
+	return fmt.Sprintf("partition-%d", hash.Sum32()%11)
 }
 
 //// END: NON EXPORTED FUNCTIONS
@@ -0,0 +1,358 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"time"
+
+	"captureorderfd/logging"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Outbox event kinds
+const (
+	EventOrderCreated       = "OrderCreated"
+	EventOrderStatusChanged = "OrderStatusChanged"
+)
+
+// Outbox event states
+const (
+	OutboxPending      = "pending"
+	OutboxSent         = "sent"
+	OutboxDeadLettered = "deadlettered"
+)
+
+// ErrEventNotFound is returned by OutboxStore when the order has no event with the given id
+var ErrEventNotFound = errors.New("outbox event not found")
+
+// OutboxEvent is a message waiting to be published. It is stored on the order it belongs to,
+// so the order and its events are always written together.
+type OutboxEvent struct {
+	ID            string            `json:"id"`
+	Kind          string            `json:"kind"`
+	ContentType   string            `json:"contentType"`
+	Headers       map[string]string `json:"headers,omitempty"`
+	Attributes    map[string]string `json:"attributes,omitempty"`
+	TraceContext  map[string]string `json:"traceContext,omitempty"` // W3C traceparent and tracestate of the request that caused the event
+	RequestID     string            `json:"requestId,omitempty"`    // X-Request-ID of the request that caused the event
+	Body          string            `json:"body"`
+	State         string            `json:"state"`
+	Attempts      int               `json:"attempts"`
+	LastError     string            `json:"lastError,omitempty"`
+	CreatedAt     time.Time         `json:"createdAt"`
+	NextAttemptAt time.Time         `json:"nextAttemptAt"`
+	SentAt        time.Time         `json:"sentAt,omitempty"`
+	ClaimedBy     string            `json:"claimedBy,omitempty"`  // the relay publishing the event
+	LeaseUntil    time.Time         `json:"leaseUntil,omitempty"` // until when no other relay may publish it
+}
+
+// releaseLease lets any relay publish the event again
+func (event *OutboxEvent) releaseLease() {
+	event.ClaimedBy = ""
+	event.LeaseUntil = time.Time{}
+}
+
+// PendingEvent is an outbox event along with the id of its order
+type PendingEvent struct {
+	OrderID string      `json:"orderId"`
+	Event   OutboxEvent `json:"event"`
+}
+
+// StuckEvents is the list of events that have been pending for too long
+type StuckEvents struct {
+	Entries []PendingEvent `json:"entries"`
+	Count   int            `json:"count"`
+}
+
+// OutboxStore gives the relay access to the events stored with the orders.
+// Implementations must be safe for concurrent use.
+type OutboxStore interface {
+	// PendingEvents returns up to limit pending events due at or before now, and not leased by a relay beyond now
+	PendingEvents(now time.Time, limit int) ([]PendingEvent, error)
+	// ClaimEvent leases a pending event to relayID until leaseUntil, in a single atomic update.
+	// It returns false if the event is no longer pending, or another relay's lease hasn't expired by now.
+	ClaimEvent(orderID string, eventID string, relayID string, now time.Time, leaseUntil time.Time) (bool, error)
+	// StuckEvents returns up to limit pending events created before createdBefore
+	StuckEvents(createdBefore time.Time, limit int) ([]PendingEvent, error)
+	// MarkEventSent records that an event was published. The Mark methods release the lease.
+	MarkEventSent(orderID string, eventID string, sentAt time.Time) error
+	// MarkEventFailed records a failed attempt and when to try again
+	MarkEventFailed(orderID string, eventID string, lastError string, nextAttemptAt time.Time) error
+	// MarkEventDeadLettered records the last failed attempt of an event handed to the dead letter sink
+	MarkEventDeadLettered(orderID string, eventID string, lastError string) error
+}
+
+// Outbox relay settings. Override with the OUTBOX_POLL_INTERVAL and OUTBOX_STUCK_AFTER environment variables, e.g. 500ms
+var outboxPollInterval = time.Second
+var outboxStuckAfter = time.Minute
+
+// Attempts at publishing an event before it is dead lettered. Override with the OUTBOX_MAX_ATTEMPTS environment variable.
+var outboxMaxAttempts = 10
+
+// How long a relay has to publish the events it claimed before another replica may take them over.
+// Override with the OUTBOX_LEASE environment variable, it must be longer than the retried publish of a batch takes.
+var outboxLease = 5 * time.Minute
+
+// Identifies the relay of this process in the leases of the events
+var outboxRelayID = newRelayID()
+
+// Events published per relay run, and the longest wait between two attempts at the same event
+const outboxBatchSize = 100
+const outboxMaxBackoff = 5 * time.Minute
+
+// Wakes the relay up as soon as an event is written, rather than on the next poll
+var outboxNudge = make(chan struct{}, 1)
+
+// newOutboxEvent creates a pending event announcing order. The transition is nil for a new order.
+func newOutboxEvent(kind string, order Order, transition *StatusTransition, correlationID string) OutboxEvent {
+	now := time.Now().UTC()
+	id := bson.NewObjectId().Hex()
+	body, contentType, headers := encodeOrderEvent(id, kind, now, order, transition, correlationID)
+	return OutboxEvent{
+		ID:            id,
+		Kind:          kind,
+		ContentType:   contentType,
+		Headers:       headers,
+		Attributes:    routingAttributes(kind, order, transition),
+		Body:          string(body),
+		State:         OutboxPending,
+		CreatedAt:     now,
+		NextAttemptAt: now,
+	}
+}
+
+// routingAttributes are the order fields messages can be routed on, see AMQP_ROUTING_KEY
+func routingAttributes(kind string, order Order, transition *StatusTransition) map[string]string {
+	attributes := map[string]string{
+		"Kind":      kind,
+		"OrderID":   order.OrderID,
+		"Product":   order.Product,
+		"Status":    order.Status,
+		"Source":    order.Source,
+		"Partition": order.Partition,
+	}
+	if transition != nil {
+		attributes["PreviousStatus"] = transition.From
+	}
+	return attributes
+}
+
+// newOrderCreatedEvent creates the event announcing a captured order
+func newOrderCreatedEvent(order Order, correlationID string) OutboxEvent {
+	return newOutboxEvent(EventOrderCreated, order, nil, correlationID)
+}
+
+// newStatusChangedEvent creates the event announcing an order status change, order already has the new status
+func newStatusChangedEvent(order Order, transition StatusTransition, correlationID string) OutboxEvent {
+	return newOutboxEvent(EventOrderStatusChanged, order, &transition, correlationID)
+}
+
+// StuckOutboxEvents Lists the events still pending after the given age, or after OUTBOX_STUCK_AFTER when it is 0
+func StuckOutboxEvents(olderThan time.Duration) ([]PendingEvent, error) {
+	if olderThan <= 0 {
+		olderThan = outboxStuckAfter
+	}
+
+	events, err := orderStore.StuckEvents(time.Now().UTC().Add(-olderThan), outboxBatchSize)
+	if err != nil {
+		trackException(context.Background(), err)
+		logging.Error("Problem reading the stuck outbox events", "error", err)
+	}
+	return events, err
+}
+
+// notifyOutbox wakes the relay up without waiting
+func notifyOutbox() {
+	select {
+	case outboxNudge <- struct{}{}:
+	default:
+	}
+}
+
+// initOutbox reads the relay settings and starts the relay
+func initOutbox() {
+	if interval, err := time.ParseDuration(os.Getenv("OUTBOX_POLL_INTERVAL")); err == nil && interval > 0 {
+		outboxPollInterval = interval
+	}
+	if stuckAfter, err := time.ParseDuration(os.Getenv("OUTBOX_STUCK_AFTER")); err == nil && stuckAfter > 0 {
+		outboxStuckAfter = stuckAfter
+	}
+	if maxAttempts, err := strconv.Atoi(os.Getenv("OUTBOX_MAX_ATTEMPTS")); err == nil && maxAttempts > 0 {
+		outboxMaxAttempts = maxAttempts
+	}
+	if lease, err := time.ParseDuration(os.Getenv("OUTBOX_LEASE")); err == nil && lease > 0 {
+		outboxLease = lease
+	}
+	logging.Info("Outbox relay polling. You can override by setting the OUTBOX_POLL_INTERVAL environment variable.", "interval", outboxPollInterval)
+	logging.Info("Dead lettering events after too many attempts. You can override by setting the OUTBOX_MAX_ATTEMPTS environment variable.", "maxAttempts", outboxMaxAttempts)
+	logging.Info("Leasing events to the relay. You can override by setting the OUTBOX_LEASE environment variable.", "relayId", outboxRelayID, "lease", outboxLease)
+
+	go runOutboxRelay()
+}
+
+// runOutboxRelay publishes pending events forever, whenever nudged or every outboxPollInterval
+func runOutboxRelay() {
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+
+	for {
+		// Keep going while there's a backlog
+		for relayOutbox() == outboxBatchSize {
+		}
+
+		select {
+		case <-outboxNudge:
+		case <-ticker.C:
+		}
+	}
+}
+
+// newRelayID returns the host name, which is the pod name on Kubernetes, and a random suffix
+func newRelayID() string {
+	host, _ := os.Hostname()
+	return host + "-" + bson.NewObjectId().Hex()
+}
+
+// relayOutbox publishes a batch of due events and returns how many it tried
+func relayOutbox() int {
+	return relayOutboxAs(outboxRelayID)
+}
+
+// relayOutboxAs publishes a batch of due events as the given relay, and returns how many it tried.
+// Each event is claimed first, so when several replicas relay the same outbox only one of them publishes it.
+func relayOutboxAs(relayID string) int {
+	if publisher == nil {
+		// AMQP is either not configured or improperly configured, events wait in the outbox
+		return 0
+	}
+
+	now := time.Now().UTC()
+	events, err := orderStore.PendingEvents(now, outboxBatchSize)
+	if err != nil {
+		trackException(context.Background(), err)
+		logging.Error("Problem reading the outbox", "error", err)
+		return 0
+	}
+
+	tried := 0
+	for _, pending := range events {
+		claimed, err := orderStore.ClaimEvent(pending.OrderID, pending.Event.ID, relayID, now, now.Add(outboxLease))
+		if err != nil {
+			trackException(context.Background(), err)
+			logging.Error("Problem claiming an outbox event", "eventId", pending.Event.ID, "orderId", pending.OrderID, "error", err)
+			continue
+		}
+		if !claimed {
+			// Another replica is publishing it
+			continue
+		}
+		tried++
+
+		ctx := eventContext(pending.Event)
+		err = publishEvent(pending.OrderID, pending.Event)
+		switch {
+		case err == nil:
+			err = orderStore.MarkEventSent(pending.OrderID, pending.Event.ID, time.Now().UTC())
+		case pending.Event.Attempts+1 >= outboxMaxAttempts:
+			// Give up on the event, unless the dead letter sink can't take it either
+			if deadLetterErr := deadLetterEvent(pending, err); deadLetterErr != nil {
+				trackException(ctx, deadLetterErr)
+				logging.FromContext(ctx).Error("Problem dead lettering an event", "eventId", pending.Event.ID, "orderId", pending.OrderID, "error", deadLetterErr)
+				err = retryEvent(pending, err)
+			} else {
+				err = nil
+			}
+		default:
+			err = retryEvent(pending, err)
+		}
+
+		if err != nil {
+			trackException(ctx, err)
+			logging.FromContext(ctx).Error("Problem updating the outbox", "eventId", pending.Event.ID, "orderId", pending.OrderID, "error", err)
+		}
+	}
+
+	return tried
+}
+
+// retryEvent records a failed attempt, backing off exponentially, 1s, 2s, 4s... up to outboxMaxBackoff
+func retryEvent(pending PendingEvent, reason error) error {
+	backoff := outboxMaxBackoff
+	if pending.Event.Attempts < 16 {
+		if b := time.Duration(1<<uint(pending.Event.Attempts)) * time.Second; b < backoff {
+			backoff = b
+		}
+	}
+	return orderStore.MarkEventFailed(pending.OrderID, pending.Event.ID, reason.Error(), time.Now().UTC().Add(backoff))
+}
+
+// eventContext returns a context holding the trace and the request id of the request that caused the event
+func eventContext(event OutboxEvent) context.Context {
+	ctx := extractTraceContext(context.Background(), event.TraceContext)
+	if event.RequestID != "" {
+		ctx = logging.WithRequestID(ctx, event.RequestID)
+	}
+	return ctx
+}
+
+// publishEvent publishes an outbox event and tracks it, in the trace and with the request id of the request that caused it
+func publishEvent(orderID string, event OutboxEvent) error {
+	startTime := time.Now()
+	ctx, span := startPublishSpan(eventContext(event), event)
+	logger := logging.FromContext(ctx)
+
+	msg := Message{
+		ID:          event.ID,
+		OrderID:     orderID,
+		ContentType: event.ContentType,
+		Attributes:  event.Attributes,
+		Body:        []byte(event.Body),
+	}
+	if len(event.Headers) > 0 {
+		msg.Headers = map[string]interface{}{}
+		for name, value := range event.Headers {
+			msg.Headers[name] = value
+		}
+	}
+
+	// Let the consumers continue the trace, and find the request in the logs
+	if traceContext := injectTraceContext(ctx); traceContext != nil {
+		if msg.Headers == nil {
+			msg.Headers = map[string]interface{}{}
+		}
+		for name, value := range traceContext {
+			msg.Headers[name] = value
+		}
+	}
+	if event.RequestID != "" {
+		if msg.Headers == nil {
+			msg.Headers = map[string]interface{}{}
+		}
+		msg.Headers[logging.RequestIDHeader] = event.RequestID
+	}
+
+	// Send message
+	err := publisher.Publish(msg)
+	endSpan(span, err)
+	if err != nil {
+		// If the team provided an Application Insights key, let's track that exception
+		trackException(ctx, err)
+		logger.Error("Problem sending the event", "kind", event.Kind, "eventId", event.ID, "orderId", orderID, "queue", queueType, "error", err)
+	} else {
+		logger.Info("Sent the event", "kind", event.Kind, "eventId", event.ID, "orderId", orderID, "queue", queueType)
+	}
+
+	endTime := time.Now()
+
+	if err == nil && event.Kind == EventOrderCreated {
+		// Track the event for the challenge purposes
+		trackSendOrderEvent(ctx, orderID)
+	}
+
+	// Track the dependency
+	trackAMQPDependency(ctx, "Send "+event.Kind, err, startTime, endTime)
+	return err
+}
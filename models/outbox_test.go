@@ -0,0 +1,158 @@
+package models
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRelayOutboxRetriesFailedEvents(t *testing.T) {
+	orderStore = newMemoryStore()
+	publisher = newMemoryPublisher(1)
+	defer func() { publisher = nil }()
+
+	confirm := StatusTransition{From: StatusOpen, To: StatusConfirmed, At: time.Now()}
+	first := newTestOrder("first@domain.com", time.Now().Add(-time.Hour))
+	first.Outbox = []OutboxEvent{newStatusChangedEvent(first, confirm, "")}
+	second := newTestOrder("second@domain.com", time.Now())
+	second.Outbox = []OutboxEvent{newStatusChangedEvent(second, confirm, "")}
+	orderStore.Create(context.Background(), first)
+	orderStore.Create(context.Background(), second)
+
+	// The buffer only has room for the first event
+	if tried := relayOutbox(); tried != 2 {
+		t.Fatalf("relayOutbox tried %d events, expected 2", tried)
+	}
+
+	received := <-MemoryMessages()
+	if received.ID != first.Outbox[0].ID || received.OrderID != first.OrderID {
+		t.Errorf("Received %+v, expected the event of order %s", received, first.OrderID)
+	}
+
+	stored, _ := orderStore.Get(context.Background(), first.OrderID)
+	if event := stored.Outbox[0]; event.State != OutboxSent || event.Attempts != 1 || event.SentAt.IsZero() {
+		t.Errorf("Published event is %+v, expected it to be sent", event)
+	}
+
+	stored, _ = orderStore.Get(context.Background(), second.OrderID)
+	failed := stored.Outbox[0]
+	if failed.State != OutboxPending || failed.Attempts != 1 || failed.LastError != ErrPublisherFull.Error() {
+		t.Errorf("Failed event is %+v, expected it to be pending with the error", failed)
+	}
+	if !failed.NextAttemptAt.After(time.Now()) {
+		t.Errorf("Failed event is due at %v, expected it to back off", failed.NextAttemptAt)
+	}
+
+	// Nothing is due until the back off is over
+	if tried := relayOutbox(); tried != 0 {
+		t.Errorf("relayOutbox tried %d events during the back off, expected 0", tried)
+	}
+
+	stuck, err := StuckOutboxEvents(time.Nanosecond)
+	if err != nil {
+		t.Fatalf("StuckOutboxEvents returned %v", err)
+	}
+	if len(stuck) != 1 || stuck[0].OrderID != second.OrderID {
+		t.Errorf("StuckOutboxEvents returned %+v, expected the event of order %s", stuck, second.OrderID)
+	}
+}
+
+func TestUpdateOrderStatusWritesOutboxEvent(t *testing.T) {
+	orderStore = newMemoryStore()
+	order := newTestOrder("test@domain.com", time.Now())
+	orderStore.Create(context.Background(), order)
+
+	if _, _, err := UpdateOrderStatus(context.Background(), order.OrderID, StatusConfirmed, "", ""); err != nil {
+		t.Fatalf("Open -> Confirmed returned %v", err)
+	}
+	// A rejected transition must not be announced
+	UpdateOrderStatus(context.Background(), order.OrderID, StatusOpen, "", "")
+
+	stored, _ := orderStore.Get(context.Background(), order.OrderID)
+	if len(stored.Outbox) != 1 {
+		t.Fatalf("The order has %d outbox events, expected 1", len(stored.Outbox))
+	}
+	if event := stored.Outbox[0]; event.Kind != EventOrderStatusChanged || event.State != OutboxPending {
+		t.Errorf("Unexpected outbox event %+v", event)
+	}
+}
+
+func TestTwoRelaysPublishEachEventOnce(t *testing.T) {
+	orderStore = newMemoryStore()
+	publisher = newMemoryPublisher(1000)
+	defer func() { publisher = nil }()
+
+	const orders = 50
+	confirm := StatusTransition{From: StatusOpen, To: StatusConfirmed, At: time.Now()}
+	for i := 0; i < orders; i++ {
+		order := newTestOrder("test@domain.com", time.Now().Add(time.Duration(i)*time.Second))
+		order.Outbox = []OutboxEvent{newStatusChangedEvent(order, confirm, "")}
+		orderStore.Create(context.Background(), order)
+	}
+
+	// Two replicas relaying the same outbox at the same time
+	tried := make(chan int)
+	for _, relayID := range []string{"replica-a", "replica-b"} {
+		go func(relayID string) { tried <- relayOutboxAs(relayID) }(relayID)
+	}
+	if total := <-tried + <-tried; total != orders {
+		t.Errorf("The relays tried %d events, expected %d", total, orders)
+	}
+
+	published := map[string]int{}
+	for len(MemoryMessages()) > 0 {
+		published[(<-MemoryMessages()).ID]++
+	}
+	if len(published) != orders {
+		t.Errorf("Published %d events, expected %d", len(published), orders)
+	}
+	for id, count := range published {
+		if count != 1 {
+			t.Errorf("Event %s was published %d times", id, count)
+		}
+	}
+	if pending, _ := orderStore.PendingEvents(time.Now().Add(time.Hour), orders); len(pending) != 0 {
+		t.Errorf("%d events are still pending", len(pending))
+	}
+}
+
+func TestLeasedEventsAreLeftToTheirRelay(t *testing.T) {
+	orderStore = newMemoryStore()
+	publisher = newMemoryPublisher(1)
+	defer func() { publisher = nil }()
+
+	confirm := StatusTransition{From: StatusOpen, To: StatusConfirmed, At: time.Now()}
+	order := newTestOrder("test@domain.com", time.Now())
+	order.Outbox = []OutboxEvent{newStatusChangedEvent(order, confirm, "")}
+	orderStore.Create(context.Background(), order)
+	eventID := order.Outbox[0].ID
+
+	now := time.Now().UTC()
+	if claimed, err := orderStore.ClaimEvent(order.OrderID, eventID, "replica-a", now, now.Add(time.Minute)); !claimed || err != nil {
+		t.Fatalf("ClaimEvent returned %t, %v", claimed, err)
+	}
+	if claimed, _ := orderStore.ClaimEvent(order.OrderID, eventID, "replica-b", now, now.Add(time.Minute)); claimed {
+		t.Error("A second relay claimed a leased event")
+	}
+	if tried := relayOutboxAs("replica-b"); tried != 0 {
+		t.Errorf("relayOutboxAs tried %d leased events, expected 0", tried)
+	}
+
+	// replica-a died, its lease expires
+	later := now.Add(2 * time.Minute)
+	if pending, _ := orderStore.PendingEvents(later, 10); len(pending) != 1 || pending[0].Event.ClaimedBy != "replica-a" {
+		t.Fatalf("PendingEvents returned %+v after the lease, expected the event", pending)
+	}
+	if claimed, _ := orderStore.ClaimEvent(order.OrderID, eventID, "replica-b", later, later.Add(time.Minute)); !claimed {
+		t.Error("The expired lease wasn't taken over")
+	}
+
+	orderStore.MarkEventSent(order.OrderID, eventID, later)
+	stored, _ := orderStore.Get(context.Background(), order.OrderID)
+	if event := stored.Outbox[0]; event.ClaimedBy != "" || !event.LeaseUntil.IsZero() {
+		t.Errorf("Sending the event didn't release the lease: %+v", event)
+	}
+	if claimed, _ := orderStore.ClaimEvent(order.OrderID, eventID, "replica-a", later, later.Add(time.Minute)); claimed {
+		t.Error("A sent event was claimed")
+	}
+}
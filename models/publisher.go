@@ -0,0 +1,141 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"captureorderfd/logging"
+)
+
+// Message is a single message handed to a Publisher
+type Message struct {
+	ID          string                 `json:"id"`
+	OrderID     string                 `json:"orderId"`
+	ContentType string                 `json:"contentType"`
+	Headers     map[string]interface{} `json:"headers,omitempty"`
+	Attributes  map[string]string      `json:"attributes,omitempty"` // routing attributes, see OutboxEvent
+	Body        []byte                 `json:"body"`
+}
+
+// messageContext returns a context holding the request id of the message, if any
+func messageContext(msg Message) context.Context {
+	if requestID, ok := msg.Headers[logging.RequestIDHeader].(string); ok && requestID != "" {
+		return logging.WithRequestID(context.Background(), requestID)
+	}
+	return context.Background()
+}
+
+// Publisher sends messages to a broker. Implementations must be safe for concurrent use.
+type Publisher interface {
+	// Publish sends a message, it returns once the broker accepted it or it definitely failed
+	Publish(msg Message) error
+	// Close releases the connection to the broker
+	Close() error
+}
+
+// ErrPublisherFull is returned by the in-memory publisher when nobody is reading its messages
+var ErrPublisherFull = errors.New("in-memory publisher buffer is full")
+
+// ErrPublisherNotConnected is returned while the publisher is reconnecting to the broker
+var ErrPublisherNotConnected = errors.New("not connected to the broker")
+
+// ErrPublishNacked is returned when the broker refused a message
+var ErrPublishNacked = errors.New("broker did not accept the message")
+
+// ErrPublishUnroutable is returned when the broker could not route a message to any queue
+var ErrPublishUnroutable = errors.New("broker could not route the message to a queue")
+
+// ErrPublishTimeout is returned when the broker did not confirm a message in time, it may or may not have been queued
+var ErrPublishTimeout = errors.New("broker did not confirm the message in time")
+
+// Default number of messages the in-memory publisher buffers, override with mem://?buffer=n
+const defaultMemoryPublisherBuffer = 1000
+
+// Queue types, used for tracking purposes
+const (
+	QueueServiceBus = "ServiceBus"
+	QueueRabbitMQ   = "RabbitMQ"
+	QueueMemory     = "Memory"
+	QueueFile       = "File"
+)
+
+// Publisher connection states, as reported by PublisherState
+const (
+	PublisherConnected     = "connected"
+	PublisherConnecting    = "reconnecting"
+	PublisherClosed        = "closed"
+	PublisherNotConfigured = "not configured"
+)
+
+// stateReporter is implemented by the publishers that can lose their connection
+type stateReporter interface {
+	State() string
+}
+
+// The publisher in use, set up by Init. Nil when AMQP is not configured or improperly configured.
+var publisher Publisher
+
+// newPublisher creates the Publisher for the AMQPURL scheme:
+//
+//	amqp:// or amqps://  RabbitMQ over AMQP 0.9.1, or ServiceBus over AMQP 1.0 for *.servicebus.windows.net
+//	Endpoint=sb://...    ServiceBus or Event Hubs over AMQP 1.0, authenticated with CBS tokens
+//	mem://               an in-process channel, read it with MemoryMessages
+//	file://path          appends one JSON message per line to path
+func newPublisher(amqpURL string) (Publisher, string, error) {
+	if isServiceBusConnectionString(amqpURL) {
+		p, err := newAMQP10PublisherFromConnectionString(amqpURL)
+		return p, QueueServiceBus, err
+	}
+
+	u, err := url.Parse(amqpURL)
+	if err != nil {
+		return nil, "", err
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "mem":
+		size := defaultMemoryPublisherBuffer
+		if buffer := u.Query().Get("buffer"); buffer != "" {
+			if size, err = strconv.Atoi(buffer); err != nil || size <= 0 {
+				return nil, QueueMemory, fmt.Errorf("mem:// buffer must be a positive number, not %q", buffer)
+			}
+		}
+		return newMemoryPublisher(size), QueueMemory, nil
+	case "file":
+		// file:///abs/path and file://relative/path both work
+		path := u.Host + u.Path
+		if path == "" {
+			path = u.Opaque
+		}
+		p, err := newFilePublisher(path)
+		return p, QueueFile, err
+	}
+
+	// Figure out if we're running on ServiceBus or elsewhere
+	if isServiceBus {
+		// Parse the ServiceBus (last part of the url)
+		p, err := newAMQP10Publisher(amqpURL, u.Path)
+		return p, QueueServiceBus, err
+	}
+	topology, err := loadAMQPTopology()
+	if err != nil {
+		return nil, QueueRabbitMQ, err
+	}
+	return newAMQP091Publisher(amqpURL, topology), QueueRabbitMQ, nil
+}
+
+// PublisherState Tells whether the publisher is connected to the broker.
+// Publishers without a connection to lose are always connected.
+func PublisherState() string {
+	if publisher == nil {
+		return PublisherNotConfigured
+	}
+	if reporter, ok := publisher.(stateReporter); ok {
+		return reporter.State()
+	}
+	return PublisherConnected
+}
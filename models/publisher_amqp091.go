@@ -0,0 +1,459 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"sync"
+	"time"
+
+	"captureorderfd/logging"
+
+	amqp091 "github.com/streadway/amqp"
+)
+
+// How long Publish waits for RabbitMQ to confirm a message. Override with the AMQP_CONFIRM_TIMEOUT environment variable, e.g. 10s
+var amqpConfirmTimeout = 5 * time.Second
+
+// Room for confirmations and returns between RabbitMQ and forwardConfirms, and between it and waitForConfirm
+const amqpConfirmBuffer = 64
+
+// Bounds of the wait between two reconnection attempts, before jitter
+const amqpMinReconnectDelay = time.Second
+const amqpMaxReconnectDelay = 30 * time.Second
+
+// amqp091Publisher publishes to RabbitMQ over AMQP 0.9.1, by default to the durable "order" queue.
+// The channel is in confirm mode and messages are mandatory, so Publish only succeeds once RabbitMQ queued the message.
+// A supervisor connects in the background, and reconnects whenever the connection or the channel is closed.
+type amqp091Publisher struct {
+	url      string
+	topology amqpTopology
+	closing  chan struct{} // closed by Close to stop the supervisor
+
+	// The state has its own lock so the health probe never waits for a publish
+	stateMu sync.Mutex
+	state   string
+
+	// Publishes are serialised so each one can wait for its own confirmation.
+	// mu also guards the connection, which the supervisor replaces.
+	mu          sync.Mutex
+	client      *amqp091.Connection
+	channel     *amqp091.Channel
+	queue       amqp091.Queue
+	deliveryTag uint64
+	confirms    chan amqp091.Confirmation // the ones forwardConfirms passes on
+	returns     chan amqp091.Return
+
+	// The message a publish waits for, forwardConfirms drops the confirmations and returns of other messages
+	awaitMu    sync.Mutex
+	awaitedID  string
+	awaitedTag uint64
+}
+
+// newAMQP091Publisher starts the supervisor, which connects to RabbitMQ and declares the topology.
+// The publisher is reconnecting until then.
+func newAMQP091Publisher(amqpURL string, topology amqpTopology) *amqp091Publisher {
+	p := &amqp091Publisher{url: amqpURL, topology: topology, closing: make(chan struct{}), state: PublisherConnecting}
+	go p.supervise()
+	return p
+}
+
+// connect dials RabbitMQ, declares the topology and puts a new channel in confirm mode
+func (p *amqp091Publisher) connect() error {
+	client, err := amqp091.Dial(p.url)
+	if err != nil {
+		customTelemetry.TrackException(err, nil)
+		return err
+	}
+
+	logging.Info("Connected to RabbitMQ. Establishing Channel, Exchange and Queue")
+
+	// Otherwise, let's continue and establish the channel, exchange and queue
+	channel, err := client.Channel()
+	if err != nil {
+		trackException(context.Background(), err)
+		client.Close()
+		return err
+	}
+
+	queue, err := p.topology.declare(channel)
+	if err != nil {
+		trackException(context.Background(), err)
+		client.Close()
+		return err
+	}
+
+	// Have RabbitMQ acknowledge every message, and return the ones it can't route to a queue
+	if err = channel.Confirm(false); err != nil {
+		trackException(context.Background(), err)
+		client.Close()
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	select {
+	case <-p.closing:
+		// Close was called while connecting
+		client.Close()
+		return amqp091.ErrClosed
+	default:
+	}
+	p.client = client
+	p.channel = channel
+	p.queue = queue
+	p.deliveryTag = 0
+	p.confirms = make(chan amqp091.Confirmation, amqpConfirmBuffer)
+	p.returns = make(chan amqp091.Return, amqpConfirmBuffer)
+	go p.forwardConfirms(
+		channel.NotifyPublish(make(chan amqp091.Confirmation, amqpConfirmBuffer)),
+		channel.NotifyReturn(make(chan amqp091.Return, amqpConfirmBuffer)),
+		p.confirms, p.returns)
+	p.setState(PublisherConnected)
+	return nil
+}
+
+// supervise connects, then waits for the connection or the channel to close and reconnects, until Close is called.
+// Reconnecting declares the topology again.
+func (p *amqp091Publisher) supervise() {
+	logging.Info("Attempting to connect to RabbitMQ")
+	if !p.connectWithBackoff() {
+		return
+	}
+
+	for {
+		p.mu.Lock()
+		client, channel := p.client, p.channel
+		p.mu.Unlock()
+
+		// Both are closed straight away if the connection is already gone
+		connectionClosed := client.NotifyClose(make(chan *amqp091.Error, 1))
+		channelClosed := channel.NotifyClose(make(chan *amqp091.Error, 1))
+
+		var reason *amqp091.Error
+		select {
+		case reason = <-connectionClosed:
+		case reason = <-channelClosed:
+		case <-p.closing:
+			return
+		}
+
+		p.setState(PublisherConnecting)
+		if reason != nil {
+			trackException(context.Background(), reason)
+		}
+		logging.Warn("Lost the connection to RabbitMQ, reconnecting", "reason", reason)
+
+		// A closed channel leaves the connection open, start afresh
+		client.Close()
+
+		// Give the broker a moment, so instances don't all reconnect at the same moment
+		select {
+		case <-time.After(amqpReconnectDelay(0)):
+		case <-p.closing:
+			return
+		}
+		if !p.connectWithBackoff() {
+			return
+		}
+		logging.Info("Reconnected to RabbitMQ")
+	}
+}
+
+// connectWithBackoff connects, waiting amqpReconnectDelay between the attempts.
+// It returns false if Close is called before it connects.
+func (p *amqp091Publisher) connectWithBackoff() bool {
+	for attempt := 1; ; attempt++ {
+		countRetry(retryRabbitMQConnect, attempt)
+		err := p.connect()
+		if err == nil {
+			return true
+		}
+		logging.Warn("Error connecting to RabbitMQ", "attempt", attempt, "error", err)
+
+		select {
+		case <-time.After(amqpReconnectDelay(attempt - 1)):
+		case <-p.closing:
+			return false
+		}
+	}
+}
+
+// amqpReconnectDelay backs off exponentially from amqpMinReconnectDelay to amqpMaxReconnectDelay.
+// A random part of up to half the delay is taken off, so instances don't all reconnect at the same moment.
+func amqpReconnectDelay(attempt int) time.Duration {
+	delay := amqpMaxReconnectDelay
+	if attempt < 16 {
+		if d := amqpMinReconnectDelay << uint(attempt); d < delay {
+			delay = d
+		}
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)))
+}
+
+// Publish sends the message to the exchange with the routing key rendered from its attributes,
+// and waits for RabbitMQ to confirm it.
+// It returns ErrPublisherNotConnected while reconnecting, and ErrPublishNacked, ErrPublishUnroutable
+// or ErrPublishTimeout when RabbitMQ didn't take the message.
+func (p *amqp091Publisher) Publish(msg Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.State() != PublisherConnected {
+		return ErrPublisherNotConnected
+	}
+
+	routingKey, err := p.topology.routingKey(msg.Attributes)
+	if err != nil {
+		return err
+	}
+
+	headers := amqp091.Table(msg.Headers)
+	if p.topology.ExchangeType == amqp091.ExchangeHeaders {
+		// Headers exchanges route on the attributes
+		headers = amqp091.Table{}
+		for name, value := range msg.Attributes {
+			headers[name] = value
+		}
+		for name, value := range msg.Headers {
+			headers[name] = value
+		}
+	}
+
+	p.awaitConfirm(msg.ID, p.deliveryTag+1)
+	err = p.channel.Publish(
+		p.topology.Exchange, // exchange
+		routingKey,          // routing key
+		true,                // mandatory
+		false,               // immediate
+		amqp091.Publishing{
+			DeliveryMode: amqp091.Persistent,
+			MessageId:    msg.ID,
+			ContentType:  msg.ContentType,
+			Headers:      headers,
+			Body:         msg.Body,
+		})
+	if err != nil {
+		return err
+	}
+
+	// Delivery tags count the messages published on the channel since it was put in confirm mode
+	p.deliveryTag++
+	return p.waitForConfirm(msg.ID, p.deliveryTag)
+}
+
+// awaitConfirm has forwardConfirms pass on the confirmation and return of the message about to be published
+func (p *amqp091Publisher) awaitConfirm(messageID string, deliveryTag uint64) {
+	p.awaitMu.Lock()
+	defer p.awaitMu.Unlock()
+	p.awaitedID = messageID
+	p.awaitedTag = deliveryTag
+}
+
+// awaited returns the message a publish waits for
+func (p *amqp091Publisher) awaited() (string, uint64) {
+	p.awaitMu.Lock()
+	defer p.awaitMu.Unlock()
+	return p.awaitedID, p.awaitedTag
+}
+
+// forwardConfirms reads the confirmations and returns of a channel until it closes, so a late one never holds up
+// the connection, heartbeats included. Those of the awaited message are passed on to confirmed and returned,
+// the others are dropped.
+func (p *amqp091Publisher) forwardConfirms(confirms <-chan amqp091.Confirmation, returns <-chan amqp091.Return, confirmed chan<- amqp091.Confirmation, returned chan<- amqp091.Return) {
+	forwardReturn := func(ret amqp091.Return) {
+		if id, _ := p.awaited(); ret.MessageId == id {
+			select {
+			case returned <- ret:
+			default:
+			}
+		}
+	}
+
+	for confirms != nil || returns != nil {
+		select {
+		case ret, ok := <-returns:
+			if !ok {
+				returns = nil
+				close(returned)
+				continue
+			}
+			forwardReturn(ret)
+		case confirm, ok := <-confirms:
+			if !ok {
+				confirms = nil
+				close(confirmed)
+				continue
+			}
+
+			// RabbitMQ sends the return before the ack, pass it on first
+			for pending := true; pending && returns != nil; {
+				select {
+				case ret, ok := <-returns:
+					if ok {
+						forwardReturn(ret)
+					}
+					pending = ok
+				default:
+					pending = false
+				}
+			}
+
+			if _, tag := p.awaited(); confirm.DeliveryTag == tag {
+				select {
+				case confirmed <- confirm:
+				default:
+				}
+			}
+		}
+	}
+}
+
+// waitForConfirm waits for the confirmation of the message with the given delivery tag
+func (p *amqp091Publisher) waitForConfirm(messageID string, deliveryTag uint64) error {
+	timeout := time.NewTimer(amqpConfirmTimeout)
+	defer timeout.Stop()
+
+	returned := false
+	for {
+		select {
+		case ret, ok := <-p.returns:
+			if !ok {
+				return amqp091.ErrClosed
+			}
+			// Returns of messages that timed out earlier are dropped
+			if ret.MessageId == messageID {
+				logging.Warn("RabbitMQ returned the message", "messageId", messageID, "reply", ret.ReplyText)
+				returned = true
+			}
+		case confirm, ok := <-p.confirms:
+			if !ok {
+				return amqp091.ErrClosed
+			}
+			if confirm.DeliveryTag < deliveryTag {
+				// Late confirmation of a message that timed out
+				continue
+			}
+			if !confirm.Ack {
+				return ErrPublishNacked
+			}
+
+			// RabbitMQ sends the return before the ack, so it is already buffered
+			select {
+			case ret, ok := <-p.returns:
+				returned = returned || (ok && ret.MessageId == messageID)
+			default:
+			}
+			if returned {
+				return ErrPublishUnroutable
+			}
+			return nil
+		case <-timeout.C:
+			return ErrPublishTimeout
+		}
+	}
+}
+
+// publishDeadLetter publishes a dead letter, as JSON, to the dead letter exchange and waits for RabbitMQ to confirm it
+func (p *amqp091Publisher) publishDeadLetter(letter DeadLetter) error {
+	body, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.State() != PublisherConnected {
+		return ErrPublisherNotConnected
+	}
+
+	p.awaitConfirm(letter.Event.ID, p.deliveryTag+1)
+	err = p.channel.Publish(
+		p.topology.DeadLetterExchange, // exchange
+		"",                            // routing key
+		true,                          // mandatory
+		false,                         // immediate
+		amqp091.Publishing{
+			DeliveryMode: amqp091.Persistent,
+			MessageId:    letter.Event.ID,
+			ContentType:  "application/json",
+			Headers: amqp091.Table{
+				"x-reason":   letter.Reason,
+				"x-attempts": int64(letter.Attempts),
+			},
+			Body: body,
+		})
+	if err != nil {
+		return err
+	}
+
+	p.deliveryTag++
+	return p.waitForConfirm(letter.Event.ID, p.deliveryTag)
+}
+
+// replayDeadLetters gets the dead letters from the dead letter queue one at a time, hands them to publish,
+// and acknowledges the published ones. It stops at the first one that can't be published.
+// Messages that are not dead letters, e.g. rejected by consumers, are left in the queue.
+func (p *amqp091Publisher) replayDeadLetters(publish func(DeadLetter) error) (int, error) {
+	var skipped []amqp091.Delivery
+	defer func() {
+		// Requeued only now, so they aren't got again
+		for _, delivery := range skipped {
+			delivery.Nack(false, true)
+		}
+	}()
+
+	replayed := 0
+	for {
+		p.mu.Lock()
+		delivery, ok, err := p.channel.Get(p.topology.DeadLetterQueue, false)
+		p.mu.Unlock()
+		if err != nil || !ok {
+			return replayed, err
+		}
+
+		var letter DeadLetter
+		if err := json.Unmarshal(delivery.Body, &letter); err != nil || letter.Event.ID == "" {
+			logging.Warn("Skipping a message which is not a dead letter", "messageId", delivery.MessageId)
+			skipped = append(skipped, delivery)
+			continue
+		}
+
+		if err := publish(letter); err != nil {
+			delivery.Nack(false, true)
+			return replayed, err
+		}
+		replayed++
+		delivery.Ack(false)
+	}
+}
+
+// State tells whether the publisher is connected or reconnecting
+func (p *amqp091Publisher) State() string {
+	p.stateMu.Lock()
+	defer p.stateMu.Unlock()
+	return p.state
+}
+
+// setState records the connection state
+func (p *amqp091Publisher) setState(state string) {
+	p.stateMu.Lock()
+	defer p.stateMu.Unlock()
+	p.state = state
+}
+
+// Close stops the supervisor and closes the connection and with it the channel
+func (p *amqp091Publisher) Close() error {
+	close(p.closing)
+
+	// Under mu, so a connection being established can't report itself connected afterwards
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.setState(PublisherClosed)
+	if p.client == nil {
+		// Never connected
+		return nil
+	}
+	return p.client.Close()
+}
@@ -0,0 +1,361 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"captureorderfd/logging"
+	"captureorderfd/msauth"
+
+	"gopkg.in/matryer/try.v1"
+	amqp10 "pack.ag/amqp"
+)
+
+// amqp10Publisher sends to a ServiceBus queue over AMQP 1.0 (sends to the Default ConsumerGroup).
+// With a connection string it authenticates with CBS tokens, which are refreshed before they expire,
+// otherwise with the credentials in the URL.
+// A supervisor reconnects in the background when the link is lost, publishes fail with ErrPublisherNotConnected meanwhile.
+type amqp10Publisher struct {
+	url         string
+	target      string
+	auth        *cbsAuth      // nil when the credentials are in the URL
+	closing     chan struct{} // closed by Close to stop the supervisor and refreshing tokens
+	closeOnce   sync.Once
+	reconnect   chan struct{} // asks the supervisor to reconnect
+	keysChanged chan struct{} // a new token is put straight away when the active key changes
+
+	mu      sync.Mutex // guards the connection, which the supervisor replaces
+	client  *amqp10.Client
+	session *amqp10.Session
+	sender  *amqp10.Sender
+	token   msauth.AccessToken // the token put on the connection
+}
+
+// newAMQP10Publisher connects to ServiceBus and opens a sender link to target
+func newAMQP10Publisher(amqpURL string, target string) (*amqp10Publisher, error) {
+	p := &amqp10Publisher{url: amqpURL, target: target, closing: make(chan struct{}), reconnect: make(chan struct{}, 1)}
+	if err := p.connect(); err != nil {
+		return nil, err
+	}
+
+	go p.supervise()
+	return p, nil
+}
+
+// newAMQP10PublisherFromConnectionString connects to the namespace of a Service Bus or Event Hubs connection string,
+// authorizes sending to its entity with a CBS token, and keeps the token fresh
+func newAMQP10PublisherFromConnectionString(connectionString string) (*amqp10Publisher, error) {
+	cs, err := msauth.ParseConnectionString(connectionString)
+	if err != nil {
+		return nil, err
+	}
+	auth, err := newCBSAuth(cs)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &amqp10Publisher{
+		url:         "amqps://" + cs.Host,
+		target:      cs.EntityPath,
+		auth:        auth,
+		closing:     make(chan struct{}),
+		reconnect:   make(chan struct{}, 1),
+		keysChanged: make(chan struct{}, 1),
+	}
+	if err := p.connect(); err != nil {
+		auth.close()
+		return nil, err
+	}
+
+	go p.supervise()
+	go p.refreshTokens()
+	if serviceBusKeyFile != "" {
+		logging.Info("Reloading the Service Bus keys periodically. You can override by setting the SERVICEBUS_KEY_RELOAD environment variable.", "file", serviceBusKeyFile, "every", serviceBusKeyReload.String())
+		go p.watchKeyFile()
+	}
+	return p, nil
+}
+
+// connect establishes the connection, session and sender when the publisher is created, retrying 3 times
+func (p *amqp10Publisher) connect() error {
+	// Try to establish the connection to AMQP
+	// with retry logic
+	err := try.Do(func(attempt int) (bool, error) {
+		countRetry(retryServiceBusConnect, attempt)
+
+		logging.Info("Attempting to connect to ServiceBus", "attempt", attempt)
+		err := p.dial()
+		if err != nil {
+			// If the team provided an Application Insights key, let's track that exception
+			trackException(context.Background(), err)
+			logging.Warn("Error connecting to ServiceBus instance. Will retry in 5 seconds", "attempt", attempt, "error", err)
+			time.Sleep(5 * time.Second) // wait
+		}
+		return attempt < 3, err
+	})
+
+	// If we still can't connect
+	if err != nil {
+		logging.Error("Couldn't connect to ServiceBus after 3 retries", "error", err)
+	}
+	return err
+}
+
+// dial opens a new connection, session and sender and puts them in place of the current ones.
+// mu is only held for the swap, so publishes don't wait for the connection to be established.
+func (p *amqp10Publisher) dial() error {
+	var client *amqp10.Client
+	var session *amqp10.Session
+	var sender *amqp10.Sender
+	var token msauth.AccessToken
+	var err error
+
+	if p.auth != nil {
+		client, err = amqp10.Dial(p.url, amqp10.ConnSASLAnonymous())
+		if err == nil {
+			logging.Debug("Authorizing with a CBS token")
+			token, err = p.putToken(client)
+		}
+	} else {
+		client, err = amqp10.Dial(p.url)
+	}
+	if err == nil {
+		// Open a session if we managed to get an amqpClient
+		logging.Info("Connected to ServiceBus. Creating a new AMQP session")
+		session, err = client.NewSession()
+	}
+	if err == nil {
+		// Create a sender
+		logging.Debug("Creating AMQP sender", "target", p.target)
+		sender, err = session.NewSender(
+			amqp10.LinkTargetAddress(p.target),
+		)
+	}
+	if err != nil {
+		if client != nil {
+			client.Close()
+		}
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	select {
+	case <-p.closing:
+		// Close was called while connecting
+		client.Close()
+		return errors.New("the ServiceBus publisher is closed")
+	default:
+	}
+	if p.client != nil {
+		p.client.Close()
+	}
+	p.client = client
+	p.session = session
+	p.sender = sender
+	p.token = token
+	return nil
+}
+
+// putToken puts the current CBS token on the connection
+func (p *amqp10Publisher) putToken(client *amqp10.Client) (msauth.AccessToken, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return p.auth.putToken(ctx, client)
+}
+
+// supervise reconnects whenever asked to, backing off like the RabbitMQ publisher, until Close is called
+func (p *amqp10Publisher) supervise() {
+	for {
+		select {
+		case <-p.reconnect:
+		case <-p.closing:
+			return
+		}
+
+		for attempt := 0; ; attempt++ {
+			select {
+			case <-time.After(amqpReconnectDelay(attempt)):
+			case <-p.closing:
+				return
+			}
+
+			countRetry(retryServiceBusConnect, attempt+1)
+			err := p.dial()
+			if err == nil {
+				logging.Info("Reconnected to ServiceBus")
+				break
+			}
+			trackException(context.Background(), err)
+			logging.Warn("Error reconnecting to ServiceBus", "attempt", attempt, "error", err)
+		}
+	}
+}
+
+// reconnectLater drops the sender, unless the supervisor replaced it already, and has the supervisor reconnect
+func (p *amqp10Publisher) reconnectLater(sender *amqp10.Sender) {
+	p.mu.Lock()
+	if sender != nil && p.sender == sender {
+		p.sender = nil
+	}
+	p.mu.Unlock()
+
+	select {
+	case p.reconnect <- struct{}{}:
+	default:
+	}
+}
+
+// refreshTokens puts a new token on the connection shortly before the current one expires,
+// or as soon as the active key changes, until Close is called.
+// When that fails it reconnects, which authorizes the new connection.
+func (p *amqp10Publisher) refreshTokens() {
+	for {
+		p.mu.Lock()
+		delay := cbsRefreshDelay(p.token)
+		p.mu.Unlock()
+
+		select {
+		case <-time.After(delay):
+		case <-p.keysChanged:
+		case <-p.closing:
+			return
+		}
+
+		err := p.refreshToken()
+		if err == nil {
+			continue
+		}
+		trackException(context.Background(), err)
+		logging.Warn("Problem refreshing the ServiceBus token, reconnecting", "error", err)
+		p.reconnectLater(nil)
+
+		// Reconnecting puts a new token, try again later rather than spin on an expired one
+		select {
+		case <-time.After(amqpMaxReconnectDelay):
+		case <-p.closing:
+			return
+		}
+	}
+}
+
+// watchKeyFile reloads the key file every serviceBusKeyReload until Close is called.
+// The link stays up, a token signed with the new active key replaces the current one.
+func (p *amqp10Publisher) watchKeyFile() {
+	ticker := time.NewTicker(serviceBusKeyReload)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.closing:
+			return
+		}
+
+		changed, err := p.auth.reloadKeys()
+		if err != nil {
+			// Keep signing with the keys we have
+			trackException(context.Background(), err)
+			logging.Error("Problem reloading the Service Bus keys", "file", serviceBusKeyFile, "error", err)
+			continue
+		}
+		if changed {
+			logging.Info("The active Service Bus key changed, putting a new token")
+			select {
+			case p.keysChanged <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// refreshToken puts a new token on the current connection, without holding mu while it waits for the CBS node
+func (p *amqp10Publisher) refreshToken() error {
+	p.mu.Lock()
+	client := p.client
+	p.mu.Unlock()
+
+	if client == nil {
+		return errors.New("not connected to ServiceBus")
+	}
+	token, err := p.putToken(client)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.client == client {
+		p.token = token
+	}
+	return nil
+}
+
+// Publish sends the message, retrying up to 3 times, each time with 5 seconds to send it.
+// When the link is lost (e.g. an amqp.DetachError) it leaves reconnecting to the supervisor and fails straight away,
+// and it returns ErrPublisherNotConnected until the supervisor reconnected.
+func (p *amqp10Publisher) Publish(msg Message) error {
+	ctx := messageContext(msg)
+
+	message := amqp10.NewMessage(msg.Body)
+	message.Properties = &amqp10.MessageProperties{MessageID: msg.ID, ContentType: msg.ContentType}
+	if len(msg.Headers) > 0 {
+		message.ApplicationProperties = msg.Headers
+	}
+
+	return try.Do(func(attempt int) (bool, error) {
+		countRetry(retryServiceBusSend, attempt)
+		p.mu.Lock()
+		sender := p.sender
+		p.mu.Unlock()
+
+		if sender == nil {
+			return false, ErrPublisherNotConnected
+		}
+
+		logging.FromContext(ctx).Debug("Attempting to send the AMQP message", "messageId", msg.ID, "orderId", msg.OrderID, "attempt", attempt)
+		// Prepare the context to timeout in 5 seconds
+		amqp10Context, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := sender.Send(amqp10Context, message)
+		cancel()
+		if err != nil {
+			trackException(ctx, err)
+			if isAMQP10LinkLost(err) {
+				p.reconnectLater(sender)
+				return false, err
+			}
+		}
+		return attempt < 3, err
+	})
+}
+
+// isAMQP10LinkLost tells whether sending failed because the link, session or connection is gone
+func isAMQP10LinkLost(err error) bool {
+	if _, ok := err.(*amqp10.DetachError); ok {
+		return true
+	}
+	return err == amqp10.ErrLinkClosed || err == amqp10.ErrSessionClosed || err == amqp10.ErrConnClosed
+}
+
+// Close stops the supervisor and refreshing tokens and closes the connection, and with it the session and sender.
+// It can be called more than once.
+func (p *amqp10Publisher) Close() error {
+	p.closeOnce.Do(func() { close(p.closing) })
+	if p.auth != nil {
+		p.auth.close()
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.client == nil {
+		return nil
+	}
+	err := p.client.Close()
+	p.client = nil
+	p.sender = nil
+	return err
+}
@@ -0,0 +1,41 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"captureorderfd/msauth"
+)
+
+func TestAMQP10PublishWhileReconnecting(t *testing.T) {
+	p := &amqp10Publisher{closing: make(chan struct{}), reconnect: make(chan struct{}, 1)}
+	defer p.Close()
+
+	done := make(chan error)
+	go func() { done <- p.Publish(Message{ID: "1", Body: []byte("{}")}) }()
+	select {
+	case err := <-done:
+		if err != ErrPublisherNotConnected {
+			t.Errorf("Publishing without a sender returned %v, expected ErrPublisherNotConnected", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Publish waited for a connection")
+	}
+}
+
+func TestAMQP10CloseTwice(t *testing.T) {
+	cs, _ := msauth.ParseConnectionString(testConnectionString)
+	auth, err := newCBSAuth(cs)
+	if err != nil {
+		t.Fatalf("newCBSAuth returned %v", err)
+	}
+	p := &amqp10Publisher{auth: auth, closing: make(chan struct{}), reconnect: make(chan struct{}, 1)}
+	go p.supervise()
+
+	if err := p.Close(); err != nil {
+		t.Errorf("Close returned %v", err)
+	}
+	if err := p.Close(); err != nil {
+		t.Errorf("Closing again returned %v", err)
+	}
+}
@@ -0,0 +1,65 @@
+package models
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// filePublisher appends every message as a line of JSON to a file, so runs can be inspected or replayed
+type filePublisher struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// fileRecord is a single line of the file
+type fileRecord struct {
+	Time        time.Time              `json:"time"`
+	ID          string                 `json:"id"`
+	OrderID     string                 `json:"orderId"`
+	ContentType string                 `json:"contentType"`
+	Headers     map[string]interface{} `json:"headers,omitempty"`
+	Body        interface{}            `json:"body"`
+}
+
+// newFilePublisher opens (or creates) path for appending
+func newFilePublisher(path string) (*filePublisher, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &filePublisher{file: file}, nil
+}
+
+// Publish appends the message. JSON bodies are embedded as is, anything else as a string.
+func (p *filePublisher) Publish(msg Message) error {
+	record := fileRecord{
+		Time:        time.Now().UTC(),
+		ID:          msg.ID,
+		OrderID:     msg.OrderID,
+		ContentType: msg.ContentType,
+		Headers:     msg.Headers,
+		Body:        string(msg.Body),
+	}
+	if json.Valid(msg.Body) {
+		record.Body = json.RawMessage(msg.Body)
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, err = p.file.Write(append(line, '\n'))
+	return err
+}
+
+// Close closes the file
+func (p *filePublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.file.Close()
+}
@@ -0,0 +1,35 @@
+package models
+
+// memoryPublisher hands messages to consumers in the same process through a buffered channel.
+// It is meant for local development and tests.
+type memoryPublisher struct {
+	messages chan Message
+}
+
+// newMemoryPublisher creates an in-memory publisher buffering up to size messages
+func newMemoryPublisher(size int) *memoryPublisher {
+	return &memoryPublisher{messages: make(chan Message, size)}
+}
+
+// Publish queues the message, or returns ErrPublisherFull rather than blocking the request
+func (p *memoryPublisher) Publish(msg Message) error {
+	select {
+	case p.messages <- msg:
+		return nil
+	default:
+		return ErrPublisherFull
+	}
+}
+
+// Close does nothing, the channel stays open so late publishers don't panic
+func (p *memoryPublisher) Close() error {
+	return nil
+}
+
+// MemoryMessages returns the messages published when AMQPURL is mem://, or nil for any other broker
+func MemoryMessages() <-chan Message {
+	if p, ok := publisher.(*memoryPublisher); ok {
+		return p.messages
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package models
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewPublisherMemory(t *testing.T) {
+	p, kind, err := newPublisher("mem://?buffer=1")
+	if err != nil {
+		t.Fatalf("newPublisher returned %v", err)
+	}
+	if kind != QueueMemory {
+		t.Errorf("mem:// gave queue type %s, expected %s", kind, QueueMemory)
+	}
+
+	msg := Message{OrderID: "1", ContentType: "application/json", Body: []byte(`{"order": "1"}`)}
+	if err := p.Publish(msg); err != nil {
+		t.Fatalf("Publish returned %v", err)
+	}
+	if err := p.Publish(msg); err != ErrPublisherFull {
+		t.Errorf("Publishing past the buffer returned %v, expected ErrPublisherFull", err)
+	}
+
+	publisher = p
+	defer func() { publisher = nil }()
+	received := <-MemoryMessages()
+	if received.OrderID != msg.OrderID || string(received.Body) != string(msg.Body) {
+		t.Errorf("Received %+v, expected %+v", received, msg)
+	}
+}
+
+func TestNewPublisherMemoryRejectsBadBuffer(t *testing.T) {
+	for _, buffer := range []string{"0", "-1", "lots"} {
+		if _, _, err := newPublisher("mem://?buffer=" + buffer); err == nil {
+			t.Errorf("newPublisher accepted a buffer of %s", buffer)
+		}
+	}
+}
+
+func TestNewPublisherFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "publisher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "orders.jsonl")
+
+	p, kind, err := newPublisher("file://" + path)
+	if err != nil {
+		t.Fatalf("newPublisher returned %v", err)
+	}
+	if kind != QueueFile {
+		t.Errorf("file:// gave queue type %s, expected %s", kind, QueueFile)
+	}
+
+	p.Publish(Message{OrderID: "1", ContentType: "application/json", Body: []byte(`{"order": "1"}`)})
+	p.Publish(Message{OrderID: "2", ContentType: "text/plain", Body: []byte("not json"), Headers: map[string]interface{}{"h": "v"}})
+	p.Close()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var records []map[string]interface{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("Line %q is not JSON: %v", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+
+	if len(records) != 2 {
+		t.Fatalf("Found %d lines, expected 2", len(records))
+	}
+	if body, ok := records[0]["body"].(map[string]interface{}); !ok || body["order"] != "1" {
+		t.Errorf("A JSON body was not embedded as JSON: %v", records[0]["body"])
+	}
+	if records[1]["body"] != "not json" {
+		t.Errorf("A plain body was not embedded as a string: %v", records[1]["body"])
+	}
+	if headers, ok := records[1]["headers"].(map[string]interface{}); !ok || headers["h"] != "v" {
+		t.Errorf("Headers were not written: %v", records[1]["headers"])
+	}
+}
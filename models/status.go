@@ -0,0 +1,61 @@
+package models
+
+import (
+	"errors"
+	"time"
+)
+
+// Order statuses
+const (
+	StatusOpen      = "Open"
+	StatusConfirmed = "Confirmed"
+	StatusFulfilled = "Fulfilled"
+	StatusCancelled = "Cancelled"
+	StatusRefunded  = "Refunded"
+)
+
+// ErrInvalidStatus is returned for a status that is not part of the order lifecycle
+var ErrInvalidStatus = errors.New("invalid order status")
+
+// ErrInvalidTransition is returned when an order can't move from its current status to the requested one
+var ErrInvalidTransition = errors.New("invalid order status transition")
+
+// statusTransitions is the order lifecycle: the statuses an order may move to from each status.
+// Cancelled and Refunded are final.
+var statusTransitions = map[string][]string{
+	StatusOpen:      {StatusConfirmed, StatusCancelled},
+	StatusConfirmed: {StatusFulfilled, StatusCancelled},
+	StatusFulfilled: {StatusRefunded},
+	StatusCancelled: {},
+	StatusRefunded:  {},
+}
+
+// StatusChange represents the status change json
+type StatusChange struct {
+	Status string `required:"true" description:"New order status: Open, Confirmed, Fulfilled, Cancelled or Refunded"`
+	Reason string `required:"false" maxLength:"500" description:"Why the status changed"`
+}
+
+// StatusTransition is an entry in the audit trail of an order's status changes
+type StatusTransition struct {
+	From   string    `required:"false" description:"Previous status, empty when the order was captured"`
+	To     string    `required:"true" description:"New status"`
+	Reason string    `required:"false" description:"Why the status changed"`
+	At     time.Time `required:"true" description:"When the status changed"`
+}
+
+// IsValidStatus tells whether status is part of the order lifecycle
+func IsValidStatus(status string) bool {
+	_, ok := statusTransitions[status]
+	return ok
+}
+
+// CanTransition tells whether an order may move from one status to another
+func CanTransition(from string, to string) bool {
+	for _, next := range statusTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,103 @@
+package models
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCanTransition(t *testing.T) {
+	statuses := []string{StatusOpen, StatusConfirmed, StatusFulfilled, StatusCancelled, StatusRefunded}
+	allowed := map[string]bool{
+		StatusOpen + "->" + StatusConfirmed:      true,
+		StatusOpen + "->" + StatusCancelled:      true,
+		StatusConfirmed + "->" + StatusFulfilled: true,
+		StatusConfirmed + "->" + StatusCancelled: true,
+		StatusFulfilled + "->" + StatusRefunded:  true,
+	}
+
+	for _, from := range statuses {
+		for _, to := range append(statuses, "Lost", "") {
+			if got := CanTransition(from, to); got != allowed[from+"->"+to] {
+				t.Errorf("CanTransition(%s, %s) = %t, expected %t", from, to, got, !got)
+			}
+		}
+	}
+	if CanTransition("Lost", StatusOpen) {
+		t.Error("An unknown status may move to Open")
+	}
+
+	for _, status := range statuses {
+		if !IsValidStatus(status) {
+			t.Errorf("%s is not a valid status", status)
+		}
+	}
+	if IsValidStatus("Lost") || IsValidStatus("open") {
+		t.Error("Lost or open is a valid status")
+	}
+}
+
+func TestUpdateOrderStatusAuditTrail(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		path     []string
+		failAt   int // index of the first illegal step, -1 when every step is legal
+		expected string
+	}{
+		{"fulfilled and refunded", []string{StatusConfirmed, StatusFulfilled, StatusRefunded}, -1, StatusRefunded},
+		{"cancelled when open", []string{StatusCancelled}, -1, StatusCancelled},
+		{"cancelled when confirmed", []string{StatusConfirmed, StatusCancelled}, -1, StatusCancelled},
+		{"refunded before fulfilled", []string{StatusConfirmed, StatusRefunded}, 1, StatusConfirmed},
+		{"reopened", []string{StatusConfirmed, StatusOpen}, 1, StatusConfirmed},
+		{"cancelled after fulfilled", []string{StatusConfirmed, StatusFulfilled, StatusCancelled}, 2, StatusFulfilled},
+		{"refunded twice", []string{StatusConfirmed, StatusFulfilled, StatusRefunded, StatusRefunded}, 3, StatusRefunded},
+		{"confirmed twice", []string{StatusConfirmed, StatusConfirmed}, 1, StatusConfirmed},
+	} {
+		orderStore = newMemoryStore()
+		ctx := context.Background()
+		order := newTestOrder("test@domain.com", time.Now())
+		orderStore.Create(ctx, order)
+
+		legal := len(test.path)
+		if test.failAt >= 0 {
+			legal = test.failAt
+		}
+		for i, status := range test.path {
+			_, transition, err := UpdateOrderStatus(ctx, order.OrderID, status, "step "+status, "")
+			if i == test.failAt {
+				if err != ErrInvalidTransition {
+					t.Errorf("%s: step %d to %s returned %v, expected ErrInvalidTransition", test.name, i, status, err)
+				}
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: step %d to %s returned %v", test.name, i, status, err)
+			}
+			if transition.To != status || transition.Reason != "step "+status || transition.At.IsZero() {
+				t.Errorf("%s: step %d recorded %+v", test.name, i, transition)
+			}
+		}
+
+		stored, err := GetOrder(ctx, order.OrderID)
+		if err != nil {
+			t.Fatalf("%s: GetOrder returned %v", test.name, err)
+		}
+		if stored.Status != test.expected {
+			t.Errorf("%s: the order is %s, expected %s", test.name, stored.Status, test.expected)
+		}
+
+		// The trail starts with the capture and chains every legal step, and only those
+		if len(stored.StatusHistory) != legal+1 {
+			t.Fatalf("%s: the audit trail has %d entries, expected %d: %+v", test.name, len(stored.StatusHistory), legal+1, stored.StatusHistory)
+		}
+		if first := stored.StatusHistory[0]; first.From != "" || first.To != StatusOpen {
+			t.Errorf("%s: the audit trail starts with %+v, expected the capture", test.name, first)
+		}
+		for i, entry := range stored.StatusHistory[1:] {
+			previous := stored.StatusHistory[i]
+			if entry.From != previous.To || entry.To != test.path[i] || entry.At.Before(previous.At) {
+				t.Errorf("%s: entry %d %+v doesn't follow %+v", test.name, i+1, entry, previous)
+			}
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrDuplicateOrder is returned by OrderStore.Create when an order with the same id already exists
+var ErrDuplicateOrder = errors.New("duplicate order id")
+
+// OrderStore persists orders. Implementations must be safe for concurrent use.
+// The context carries the request id the calls are tracked with.
+type OrderStore interface {
+	// Create stores a new order along with its outbox, its OrderID must already be set
+	Create(ctx context.Context, order Order) error
+	// Get returns the order with the given id, or ErrOrderNotFound
+	Get(ctx context.Context, orderID string) (Order, error)
+	// List returns up to limit orders matching filter with an id greater than cursor, sorted by id
+	List(ctx context.Context, filter OrderFilter, cursor string, limit int) ([]Order, error)
+	// UpdateStatus applies transition to an order and adds event to its outbox, provided its status is still transition.From.
+	// It returns ErrOrderNotFound if the order doesn't exist and ErrInvalidTransition if its status moved on.
+	UpdateStatus(ctx context.Context, orderID string, transition StatusTransition, event OutboxEvent) error
+	// Delete removes an order, or returns ErrOrderNotFound
+	Delete(ctx context.Context, orderID string) error
+}
+
+// IdempotencyStore remembers which order each Idempotency-Key captured.
+// Implementations must be safe for concurrent use.
+type IdempotencyStore interface {
+	// Claim stores record unless a record with the same key, younger than window, already exists.
+	// It returns true if record was stored, otherwise false and the existing record.
+	Claim(record IdempotencyRecord, window time.Duration) (IdempotencyRecord, bool, error)
+	// TakeOver gives the key of expired, whose lease ran out, a new order id and lease,
+	// unless the record changed since it was read. It returns true if the key was taken over.
+	TakeOver(expired IdempotencyRecord, orderID string, leaseUntil time.Time) (bool, error)
+	// Complete records the order captured for a claimed key, ending its lease
+	Complete(key string, orderID string) error
+	// Release ends the lease of a claimed key that hasn't been completed, if it still runs until leaseUntil
+	Release(key string, leaseUntil time.Time) error
+}
+
+// Store is an OrderStore, an IdempotencyStore and an OutboxStore
+type Store interface {
+	OrderStore
+	IdempotencyStore
+	OutboxStore
+}
+
+// Supported ORDER_STORE values
+const (
+	StoreMongoDB = "mongodb"
+	StoreMemory  = "memory"
+)
+
+// The store in use, set up by Init
+var orderStore Store
+
+// UseStore Replaces the store in use with a new one of the given kind, StoreMongoDB or StoreMemory,
+// e.g. to test the controllers against the memory store
+func UseStore(kind string) error {
+	store, err := newStore(kind)
+	if err != nil {
+		return err
+	}
+	orderStore = store
+	return nil
+}
+
+// newStore creates the Store selected by the ORDER_STORE environment variable
+func newStore(kind string) (Store, error) {
+	switch strings.ToLower(kind) {
+	case "", StoreMongoDB:
+		return newMongoStore(mongoURL)
+	case StoreMemory:
+		return newMemoryStore(), nil
+	}
+	return nil, fmt.Errorf("unknown ORDER_STORE %q, use %s or %s", kind, StoreMongoDB, StoreMemory)
+}
@@ -0,0 +1,303 @@
+package models
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// memoryStore is a Store that keeps everything in process memory.
+// It is meant for local development and tests, everything is lost on restart.
+type memoryStore struct {
+	mu          sync.RWMutex
+	orders      map[string]Order
+	orderIDs    []string // sorted
+	idempotency map[string]IdempotencyRecord
+}
+
+// newMemoryStore creates an empty in-memory Store
+func newMemoryStore() *memoryStore {
+	db = "Memory"
+	return &memoryStore{
+		orders:      map[string]Order{},
+		idempotency: map[string]IdempotencyRecord{},
+	}
+}
+
+// Create stores a copy of the order
+func (s *memoryStore) Create(ctx context.Context, order Order) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.orders[order.OrderID]; ok {
+		return ErrDuplicateOrder
+	}
+
+	s.orders[order.OrderID] = copyOrder(order)
+
+	// Keep the ids sorted, new ids are almost always the greatest
+	i := sort.SearchStrings(s.orderIDs, order.OrderID)
+	s.orderIDs = append(s.orderIDs, "")
+	copy(s.orderIDs[i+1:], s.orderIDs[i:])
+	s.orderIDs[i] = order.OrderID
+	return nil
+}
+
+// Get returns a copy of the order
+func (s *memoryStore) Get(ctx context.Context, orderID string) (Order, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	order, ok := s.orders[orderID]
+	if !ok {
+		return Order{}, ErrOrderNotFound
+	}
+	return copyOrder(order), nil
+}
+
+// List pages through the orders sorted by id
+func (s *memoryStore) List(ctx context.Context, filter OrderFilter, cursor string, limit int) ([]Order, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	orders := []Order{}
+	for i := sort.SearchStrings(s.orderIDs, cursor); i < len(s.orderIDs) && len(orders) < limit; i++ {
+		order := s.orders[s.orderIDs[i]]
+		if order.OrderID == cursor || !filter.matches(order) {
+			continue
+		}
+		orders = append(orders, copyOrder(order))
+	}
+	return orders, nil
+}
+
+// UpdateStatus applies the transition and adds the event if the order still has the expected status
+func (s *memoryStore) UpdateStatus(ctx context.Context, orderID string, transition StatusTransition, event OutboxEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	order, ok := s.orders[orderID]
+	if !ok {
+		return ErrOrderNotFound
+	}
+	if order.Status != transition.From {
+		return ErrInvalidTransition
+	}
+
+	order = copyOrder(order)
+	order.Status = transition.To
+	order.StatusHistory = append(order.StatusHistory, transition)
+	order.Outbox = append(order.Outbox, event)
+	s.orders[orderID] = order
+	return nil
+}
+
+// Delete removes the order
+func (s *memoryStore) Delete(ctx context.Context, orderID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.orders[orderID]; !ok {
+		return ErrOrderNotFound
+	}
+
+	delete(s.orders, orderID)
+	i := sort.SearchStrings(s.orderIDs, orderID)
+	s.orderIDs = append(s.orderIDs[:i], s.orderIDs[i+1:]...)
+	return nil
+}
+
+// Claim stores the record unless its key was claimed within the window
+func (s *memoryStore) Claim(record IdempotencyRecord, window time.Duration) (IdempotencyRecord, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.idempotency[record.Key]; ok && record.CreatedAt.Sub(existing.CreatedAt) <= window {
+		return existing, false, nil
+	}
+
+	s.idempotency[record.Key] = record
+	return record, true, nil
+}
+
+// TakeOver gives an expired claim a new order id and lease, unless it changed since it was read
+func (s *memoryStore) TakeOver(expired IdempotencyRecord, orderID string, leaseUntil time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, ok := s.idempotency[expired.Key]
+	if !ok || record.OrderID != expired.OrderID || !record.LeaseUntil.Equal(expired.LeaseUntil) {
+		return false, nil
+	}
+	record.OrderID = orderID
+	record.LeaseUntil = leaseUntil
+	s.idempotency[expired.Key] = record
+	return true, nil
+}
+
+// Complete records the order captured for a claimed key, ending its lease
+func (s *memoryStore) Complete(key string, orderID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, ok := s.idempotency[key]
+	if !ok {
+		return ErrInvalidIdempotencyKey
+	}
+	record.OrderID = orderID
+	record.LeaseUntil = time.Time{}
+	s.idempotency[key] = record
+	return nil
+}
+
+// Release ends the lease of a claimed key that hasn't been completed, unless another request took it over
+func (s *memoryStore) Release(key string, leaseUntil time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if record, ok := s.idempotency[key]; ok && !record.completed() && record.LeaseUntil.Equal(leaseUntil) {
+		record.LeaseUntil = time.Now().UTC()
+		s.idempotency[key] = record
+	}
+	return nil
+}
+
+// PendingEvents returns the pending events due at or before now and not leased beyond now, oldest order first
+func (s *memoryStore) PendingEvents(now time.Time, limit int) ([]PendingEvent, error) {
+	return s.findEvents(limit, func(event OutboxEvent) bool {
+		return !event.NextAttemptAt.After(now) && !event.LeaseUntil.After(now)
+	}), nil
+}
+
+// ClaimEvent leases a pending event to relayID unless another relay holds an unexpired lease
+func (s *memoryStore) ClaimEvent(orderID string, eventID string, relayID string, now time.Time, leaseUntil time.Time) (bool, error) {
+	claimed := false
+	err := s.updateEvent(orderID, eventID, func(event *OutboxEvent) {
+		if event.State == OutboxPending && !event.LeaseUntil.After(now) {
+			event.ClaimedBy = relayID
+			event.LeaseUntil = leaseUntil
+			claimed = true
+		}
+	})
+	if err == ErrEventNotFound || err == ErrOrderNotFound {
+		return false, nil
+	}
+	return claimed, err
+}
+
+// StuckEvents returns the pending events created before createdBefore, oldest order first
+func (s *memoryStore) StuckEvents(createdBefore time.Time, limit int) ([]PendingEvent, error) {
+	return s.findEvents(limit, func(event OutboxEvent) bool {
+		return event.CreatedAt.Before(createdBefore)
+	}), nil
+}
+
+// MarkEventSent records that an event was published
+func (s *memoryStore) MarkEventSent(orderID string, eventID string, sentAt time.Time) error {
+	return s.updateEvent(orderID, eventID, func(event *OutboxEvent) {
+		event.State = OutboxSent
+		event.SentAt = sentAt
+		event.Attempts++
+		event.releaseLease()
+	})
+}
+
+// MarkEventFailed records a failed attempt and when to try again
+func (s *memoryStore) MarkEventFailed(orderID string, eventID string, lastError string, nextAttemptAt time.Time) error {
+	return s.updateEvent(orderID, eventID, func(event *OutboxEvent) {
+		event.LastError = lastError
+		event.NextAttemptAt = nextAttemptAt
+		event.Attempts++
+		event.releaseLease()
+	})
+}
+
+// MarkEventDeadLettered records the last failed attempt of an event handed to the dead letter sink
+func (s *memoryStore) MarkEventDeadLettered(orderID string, eventID string, lastError string) error {
+	return s.updateEvent(orderID, eventID, func(event *OutboxEvent) {
+		event.State = OutboxDeadLettered
+		event.LastError = lastError
+		event.Attempts++
+		event.releaseLease()
+	})
+}
+
+// findEvents returns up to limit pending events that match
+func (s *memoryStore) findEvents(limit int, match func(OutboxEvent) bool) []PendingEvent {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	events := []PendingEvent{}
+	for _, orderID := range s.orderIDs {
+		for _, event := range s.orders[orderID].Outbox {
+			if len(events) == limit {
+				return events
+			}
+			if event.State == OutboxPending && match(event) {
+				events = append(events, PendingEvent{OrderID: orderID, Event: event})
+			}
+		}
+	}
+	return events
+}
+
+// updateEvent changes a single outbox event
+func (s *memoryStore) updateEvent(orderID string, eventID string, update func(*OutboxEvent)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	order, ok := s.orders[orderID]
+	if !ok {
+		return ErrOrderNotFound
+	}
+
+	order = copyOrder(order)
+	for i := range order.Outbox {
+		if order.Outbox[i].ID == eventID {
+			update(&order.Outbox[i])
+			s.orders[orderID] = order
+			return nil
+		}
+	}
+	return ErrEventNotFound
+}
+
+// matches tells whether an order passes the filter
+func (f OrderFilter) matches(order Order) bool {
+	if (f.EmailAddress != "" && order.EmailAddress != f.EmailAddress) ||
+		(f.Status != "" && order.Status != f.Status) ||
+		(f.Product != "" && order.Product != f.Product) ||
+		(f.Source != "" && order.Source != f.Source) ||
+		(f.Partition != "" && order.Partition != f.Partition) {
+		return false
+	}
+
+	if !f.CreatedFrom.IsZero() || !f.CreatedTo.IsZero() {
+		if !bson.IsObjectIdHex(order.OrderID) {
+			return false
+		}
+		// Same precision as the ObjectId bounds used with MongoDB
+		createdAt := bson.ObjectIdHex(order.OrderID).Time()
+		if !f.CreatedFrom.IsZero() && createdAt.Before(f.CreatedFrom.Truncate(time.Second)) {
+			return false
+		}
+		if !f.CreatedTo.IsZero() && !createdAt.Before(f.CreatedTo.Truncate(time.Second)) {
+			return false
+		}
+	}
+	return true
+}
+
+// copyOrder copies an order so callers can't change the stored status history or outbox
+func copyOrder(order Order) Order {
+	if order.StatusHistory != nil {
+		order.StatusHistory = append([]StatusTransition(nil), order.StatusHistory...)
+	}
+	if order.Outbox != nil {
+		order.Outbox = append([]OutboxEvent(nil), order.Outbox...)
+	}
+	return order
+}
@@ -0,0 +1,154 @@
+package models
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func newTestOrder(email string, createdAt time.Time) Order {
+	return Order{
+		OrderID:       bson.NewObjectIdWithTime(createdAt).Hex(),
+		EmailAddress:  email,
+		Status:        StatusOpen,
+		StatusHistory: []StatusTransition{{To: StatusOpen, At: createdAt}},
+	}
+}
+
+func TestMemoryStoreCreateAndGet(t *testing.T) {
+	store := newMemoryStore()
+	order := newTestOrder("test@domain.com", time.Now())
+
+	if err := store.Create(context.Background(), order); err != nil {
+		t.Fatalf("Create returned %v", err)
+	}
+	if err := store.Create(context.Background(), order); err != ErrDuplicateOrder {
+		t.Errorf("Creating the same order twice returned %v, expected ErrDuplicateOrder", err)
+	}
+
+	stored, err := store.Get(context.Background(), order.OrderID)
+	if err != nil {
+		t.Fatalf("Get returned %v", err)
+	}
+	if stored.EmailAddress != order.EmailAddress {
+		t.Errorf("Get returned email %q, expected %q", stored.EmailAddress, order.EmailAddress)
+	}
+
+	// Changing the returned order must not change the stored one
+	stored.StatusHistory[0].To = StatusRefunded
+	if again, _ := store.Get(context.Background(), order.OrderID); again.StatusHistory[0].To != StatusOpen {
+		t.Error("The stored status history was changed through a returned order")
+	}
+
+	if _, err := store.Get(context.Background(), bson.NewObjectId().Hex()); err != ErrOrderNotFound {
+		t.Errorf("Get of a missing order returned %v, expected ErrOrderNotFound", err)
+	}
+}
+
+func TestMemoryStoreUpdateStatusAndDelete(t *testing.T) {
+	store := newMemoryStore()
+	order := newTestOrder("test@domain.com", time.Now())
+	store.Create(context.Background(), order)
+
+	confirm := StatusTransition{From: StatusOpen, To: StatusConfirmed, At: time.Now()}
+	if err := store.UpdateStatus(context.Background(), order.OrderID, confirm, newStatusChangedEvent(order, confirm, "")); err != nil {
+		t.Fatalf("UpdateStatus returned %v", err)
+	}
+
+	// The order is no longer Open, so the same transition can't be applied again
+	if err := store.UpdateStatus(context.Background(), order.OrderID, confirm, newStatusChangedEvent(order, confirm, "")); err != ErrInvalidTransition {
+		t.Errorf("A stale transition returned %v, expected ErrInvalidTransition", err)
+	}
+
+	stored, _ := store.Get(context.Background(), order.OrderID)
+	if stored.Status != StatusConfirmed || len(stored.StatusHistory) != 2 {
+		t.Errorf("The order is %s with %d transitions, expected Confirmed with 2", stored.Status, len(stored.StatusHistory))
+	}
+
+	if err := store.Delete(context.Background(), order.OrderID); err != nil {
+		t.Fatalf("Delete returned %v", err)
+	}
+	if err := store.Delete(context.Background(), order.OrderID); err != ErrOrderNotFound {
+		t.Errorf("Deleting a missing order returned %v, expected ErrOrderNotFound", err)
+	}
+	if err := store.UpdateStatus(context.Background(), order.OrderID, confirm, newStatusChangedEvent(order, confirm, "")); err != ErrOrderNotFound {
+		t.Errorf("Updating a missing order returned %v, expected ErrOrderNotFound", err)
+	}
+}
+
+func TestListOrdersPagesAndFilters(t *testing.T) {
+	orderStore = newMemoryStore()
+	start := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 5; i++ {
+		order := newTestOrder("test@domain.com", start.Add(time.Duration(i)*time.Hour))
+		if i%2 == 1 {
+			order.EmailAddress = "other@domain.com"
+		}
+		orderStore.Create(context.Background(), order)
+	}
+
+	var seen []Order
+	cursor := ""
+	for pages := 0; pages < 5; pages++ {
+		page, err := ListOrders(context.Background(), OrderFilter{}, cursor, 2)
+		if err != nil {
+			t.Fatalf("ListOrders returned %v", err)
+		}
+		seen = append(seen, page.Orders...)
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+	if len(seen) != 5 {
+		t.Fatalf("Paging returned %d orders, expected 5", len(seen))
+	}
+	for i := 1; i < len(seen); i++ {
+		if seen[i-1].OrderID >= seen[i].OrderID {
+			t.Errorf("Orders are not sorted oldest first: %s before %s", seen[i-1].OrderID, seen[i].OrderID)
+		}
+	}
+
+	page, _ := ListOrders(context.Background(), OrderFilter{EmailAddress: "other@domain.com"}, "", 10)
+	if page.Count != 2 {
+		t.Errorf("Filtering on email returned %d orders, expected 2", page.Count)
+	}
+
+	page, _ = ListOrders(context.Background(), OrderFilter{CreatedFrom: start.Add(time.Hour), CreatedTo: start.Add(3 * time.Hour)}, "", 10)
+	if page.Count != 2 {
+		t.Errorf("Filtering on creation time returned %d orders, expected 2", page.Count)
+	}
+
+	if _, err := ListOrders(context.Background(), OrderFilter{}, "not-a-cursor", 10); err != ErrInvalidCursor {
+		t.Errorf("A malformed cursor returned %v, expected ErrInvalidCursor", err)
+	}
+}
+
+func TestUpdateOrderStatusEnforcesLifecycle(t *testing.T) {
+	orderStore = newMemoryStore()
+	order := newTestOrder("test@domain.com", time.Now())
+	orderStore.Create(context.Background(), order)
+
+	if _, _, err := UpdateOrderStatus(context.Background(), order.OrderID, StatusFulfilled, "", ""); err != ErrInvalidTransition {
+		t.Errorf("Open -> Fulfilled returned %v, expected ErrInvalidTransition", err)
+	}
+	if _, _, err := UpdateOrderStatus(context.Background(), order.OrderID, "Lost", "", ""); err != ErrInvalidStatus {
+		t.Errorf("An unknown status returned %v, expected ErrInvalidStatus", err)
+	}
+
+	updated, transition, err := UpdateOrderStatus(context.Background(), order.OrderID, StatusCancelled, "Changed my mind", "")
+	if err != nil {
+		t.Fatalf("Open -> Cancelled returned %v", err)
+	}
+	if updated.Status != StatusCancelled || transition.From != StatusOpen || transition.Reason != "Changed my mind" {
+		t.Errorf("Unexpected order %+v after transition %+v", updated, transition)
+	}
+
+	current, _, err := UpdateOrderStatus(context.Background(), order.OrderID, StatusConfirmed, "", "")
+	if err != ErrInvalidTransition || current.Status != StatusCancelled {
+		t.Errorf("Cancelled -> Confirmed returned %v with status %s, expected ErrInvalidTransition with Cancelled", err, current.Status)
+	}
+}
@@ -0,0 +1,557 @@
+package models
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"captureorderfd/logging"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// MongoDB database and collection names
+var mongoDatabaseName = "k8orders"
+var mongoCollectionName = "orders"
+var mongoCollectionShardKey = "partition"
+
+// MongoDB collection holding the Idempotency-Keys, keyed (and so uniquely indexed) on the key itself
+var idempotencyCollectionName = "idempotency"
+
+// For tracking and code branching purposes
+var isCosmosDb = strings.Contains(mongoURL, "documents.azure.com")
+
+// mongoStore is the MongoDB/CosmosDB Store
+type mongoStore struct {
+	session *mgo.Session
+	url     string
+}
+
+// newMongoStore connects to MongoDB/CosmosDB and prepares the collections
+func newMongoStore(mongoURL string) (*mongoStore, error) {
+	session, err := initMongoDial(mongoURL)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &mongoStore{session: session, url: mongoURL}
+	store.initCollections()
+	return store, nil
+}
+
+// Create inserts the order into the orders collection
+func (s *mongoStore) Create(ctx context.Context, order Order) error {
+	startTime := time.Now()
+
+	// Use the existing mongoDBSessionCopy
+	mongoDBSessionCopy := s.session.Copy()
+	defer mongoDBSessionCopy.Close()
+
+	logging.FromContext(ctx).Debug("Inserting into MongoDB", "orderId", order.OrderID, "url", s.url, "cosmosDB", isCosmosDb)
+
+	// The unique index on the partition and the order id only holds if the partition follows from the id
+	order.Partition = orderPartition(order.OrderID)
+
+	// insert Document in collection
+	err := mongoDBSessionCopy.DB(mongoDatabaseName).C(mongoCollectionName).Insert(order)
+	if mgo.IsDup(err) {
+		err = ErrDuplicateOrder
+	}
+
+	s.trackDependency(ctx, "Insert order", err == nil, err, startTime, time.Now())
+	return err
+}
+
+// Get finds an order by its id
+func (s *mongoStore) Get(ctx context.Context, orderID string) (Order, error) {
+	var order Order
+	startTime := time.Now()
+
+	// Use the existing mongoDBSessionCopy
+	mongoDBSessionCopy := s.session.Copy()
+	defer mongoDBSessionCopy.Close()
+
+	err := mongoDBSessionCopy.DB(mongoDatabaseName).C(mongoCollectionName).Find(bson.M{"orderid": orderID}).One(&order)
+
+	// A missing order is still a successful round trip to the database
+	s.trackDependency(ctx, "Get order", err == nil || err == mgo.ErrNotFound, err, startTime, time.Now())
+
+	if err == mgo.ErrNotFound {
+		return order, ErrOrderNotFound
+	}
+	return order, err
+}
+
+// List pages through the orders sorted by id
+func (s *mongoStore) List(ctx context.Context, filter OrderFilter, cursor string, limit int) ([]Order, error) {
+	orders := []Order{}
+
+	query := bson.M{}
+	if filter.EmailAddress != "" {
+		query["emailaddress"] = filter.EmailAddress
+	}
+	if filter.Status != "" {
+		query["status"] = filter.Status
+	}
+	if filter.Product != "" {
+		query["product"] = filter.Product
+	}
+	if filter.Source != "" {
+		query["source"] = filter.Source
+	}
+	if filter.Partition != "" {
+		query["partition"] = filter.Partition
+	}
+
+	// The order id is a hex ObjectId, so it sorts in creation order and embeds the creation time
+	orderIDRange := bson.M{}
+	if cursor != "" {
+		orderIDRange["$gt"] = cursor
+	}
+	if !filter.CreatedFrom.IsZero() {
+		orderIDRange["$gte"] = bson.NewObjectIdWithTime(filter.CreatedFrom).Hex()
+	}
+	if !filter.CreatedTo.IsZero() {
+		orderIDRange["$lt"] = bson.NewObjectIdWithTime(filter.CreatedTo).Hex()
+	}
+	if len(orderIDRange) > 0 {
+		query["orderid"] = orderIDRange
+	}
+
+	startTime := time.Now()
+
+	// Use the existing mongoDBSessionCopy
+	mongoDBSessionCopy := s.session.Copy()
+	defer mongoDBSessionCopy.Close()
+
+	err := mongoDBSessionCopy.DB(mongoDatabaseName).C(mongoCollectionName).Find(query).Sort("orderid").Limit(limit).All(&orders)
+
+	s.trackDependency(ctx, "List orders", err == nil, err, startTime, time.Now())
+	return orders, err
+}
+
+// UpdateStatus sets the status of an order and appends the transition to its history and the event to its outbox.
+// Both are written by the same update, so the event is published if and only if the status changed.
+func (s *mongoStore) UpdateStatus(ctx context.Context, orderID string, transition StatusTransition, event OutboxEvent) error {
+	startTime := time.Now()
+
+	// Use the existing mongoDBSessionCopy
+	mongoDBSessionCopy := s.session.Copy()
+	defer mongoDBSessionCopy.Close()
+
+	// Only update if nobody changed the status since it was read
+	collection := mongoDBSessionCopy.DB(mongoDatabaseName).C(mongoCollectionName)
+	err := collection.Update(
+		bson.M{"orderid": orderID, "status": transition.From},
+		bson.M{
+			"$set":  bson.M{"status": transition.To},
+			"$push": bson.M{"statushistory": transition, "outbox": event},
+		})
+
+	s.trackDependency(ctx, "Update order status", err == nil || err == mgo.ErrNotFound, err, startTime, time.Now())
+
+	if err == mgo.ErrNotFound {
+		// Either the order is gone or its status moved on
+		count, countErr := collection.Find(bson.M{"orderid": orderID}).Count()
+		if countErr != nil {
+			return countErr
+		}
+		if count == 0 {
+			return ErrOrderNotFound
+		}
+		return ErrInvalidTransition
+	}
+	return err
+}
+
+// Delete removes an order
+func (s *mongoStore) Delete(ctx context.Context, orderID string) error {
+	startTime := time.Now()
+
+	// Use the existing mongoDBSessionCopy
+	mongoDBSessionCopy := s.session.Copy()
+	defer mongoDBSessionCopy.Close()
+
+	err := mongoDBSessionCopy.DB(mongoDatabaseName).C(mongoCollectionName).Remove(bson.M{"orderid": orderID})
+
+	s.trackDependency(ctx, "Delete order", err == nil || err == mgo.ErrNotFound, err, startTime, time.Now())
+
+	if err == mgo.ErrNotFound {
+		return ErrOrderNotFound
+	}
+	return err
+}
+
+// PendingEvents returns the pending events due at or before now and not leased beyond now, oldest order first
+func (s *mongoStore) PendingEvents(now time.Time, limit int) ([]PendingEvent, error) {
+	return s.findEvents("Read outbox", bson.M{"state": OutboxPending, "nextattemptat": bson.M{"$lte": now}, "$or": leaseExpired(now)}, limit, func(event OutboxEvent) bool {
+		return !event.NextAttemptAt.After(now) && !event.LeaseUntil.After(now)
+	})
+}
+
+// ClaimEvent leases a pending event to relayID in a single conditional update,
+// which only matches while no other relay holds an unexpired lease
+func (s *mongoStore) ClaimEvent(orderID string, eventID string, relayID string, now time.Time, leaseUntil time.Time) (bool, error) {
+	startTime := time.Now()
+
+	// Use the existing mongoDBSessionCopy
+	mongoDBSessionCopy := s.session.Copy()
+	defer mongoDBSessionCopy.Close()
+
+	err := mongoDBSessionCopy.DB(mongoDatabaseName).C(mongoCollectionName).Update(
+		bson.M{"orderid": orderID, "outbox": bson.M{"$elemMatch": bson.M{"id": eventID, "state": OutboxPending, "$or": leaseExpired(now)}}},
+		bson.M{"$set": bson.M{"outbox.$.claimedby": relayID, "outbox.$.leaseuntil": leaseUntil}})
+
+	s.trackDependency(context.Background(), "Claim outbox event", err == nil || err == mgo.ErrNotFound, err, startTime, time.Now())
+
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// leaseExpired matches the events whose lease expired by now, or that were never leased
+func leaseExpired(now time.Time) []bson.M {
+	return []bson.M{{"leaseuntil": bson.M{"$lte": now}}, {"leaseuntil": bson.M{"$exists": false}}}
+}
+
+// withReleasedLease adds the release of the lease of the event to a $set
+func withReleasedLease(set bson.M) bson.M {
+	set["outbox.$.claimedby"] = ""
+	set["outbox.$.leaseuntil"] = time.Time{}
+	return set
+}
+
+// StuckEvents returns the pending events created before createdBefore, oldest order first
+func (s *mongoStore) StuckEvents(createdBefore time.Time, limit int) ([]PendingEvent, error) {
+	return s.findEvents("Read stuck outbox", bson.M{"state": OutboxPending, "createdat": bson.M{"$lt": createdBefore}}, limit, func(event OutboxEvent) bool {
+		return event.CreatedAt.Before(createdBefore)
+	})
+}
+
+// MarkEventSent records that an event was published
+func (s *mongoStore) MarkEventSent(orderID string, eventID string, sentAt time.Time) error {
+	return s.updateEvent("Mark outbox event sent", orderID, eventID, bson.M{
+		"$set": withReleasedLease(bson.M{"outbox.$.state": OutboxSent, "outbox.$.sentat": sentAt}),
+		"$inc": bson.M{"outbox.$.attempts": 1},
+	})
+}
+
+// MarkEventFailed records a failed attempt and when to try again
+func (s *mongoStore) MarkEventFailed(orderID string, eventID string, lastError string, nextAttemptAt time.Time) error {
+	return s.updateEvent("Mark outbox event failed", orderID, eventID, bson.M{
+		"$set": withReleasedLease(bson.M{"outbox.$.lasterror": lastError, "outbox.$.nextattemptat": nextAttemptAt}),
+		"$inc": bson.M{"outbox.$.attempts": 1},
+	})
+}
+
+// MarkEventDeadLettered records the last failed attempt of an event handed to the dead letter sink
+func (s *mongoStore) MarkEventDeadLettered(orderID string, eventID string, lastError string) error {
+	return s.updateEvent("Mark outbox event dead lettered", orderID, eventID, bson.M{
+		"$set": withReleasedLease(bson.M{"outbox.$.state": OutboxDeadLettered, "outbox.$.lasterror": lastError}),
+		"$inc": bson.M{"outbox.$.attempts": 1},
+	})
+}
+
+// findEvents finds the orders with an outbox event matching eventQuery, then picks the events out with match
+func (s *mongoStore) findEvents(data string, eventQuery bson.M, limit int, match func(OutboxEvent) bool) ([]PendingEvent, error) {
+	var orders []Order
+	startTime := time.Now()
+
+	// Use the existing mongoDBSessionCopy
+	mongoDBSessionCopy := s.session.Copy()
+	defer mongoDBSessionCopy.Close()
+
+	err := mongoDBSessionCopy.DB(mongoDatabaseName).C(mongoCollectionName).
+		Find(bson.M{"outbox": bson.M{"$elemMatch": eventQuery}}).
+		Select(bson.M{"orderid": 1, "outbox": 1}).
+		Sort("orderid").Limit(limit).All(&orders)
+
+	s.trackDependency(context.Background(), data, err == nil, err, startTime, time.Now())
+
+	events := []PendingEvent{}
+	for _, order := range orders {
+		for _, event := range order.Outbox {
+			if len(events) == limit {
+				return events, err
+			}
+			if event.State == OutboxPending && match(event) {
+				events = append(events, PendingEvent{OrderID: order.OrderID, Event: event})
+			}
+		}
+	}
+	return events, err
+}
+
+// updateEvent applies update to a single outbox event through the positional operator
+func (s *mongoStore) updateEvent(data string, orderID string, eventID string, update bson.M) error {
+	startTime := time.Now()
+
+	// Use the existing mongoDBSessionCopy
+	mongoDBSessionCopy := s.session.Copy()
+	defer mongoDBSessionCopy.Close()
+
+	err := mongoDBSessionCopy.DB(mongoDatabaseName).C(mongoCollectionName).
+		Update(bson.M{"orderid": orderID, "outbox.id": eventID}, update)
+
+	s.trackDependency(context.Background(), data, err == nil || err == mgo.ErrNotFound, err, startTime, time.Now())
+
+	if err == mgo.ErrNotFound {
+		return ErrEventNotFound
+	}
+	return err
+}
+
+// Claim inserts the idempotency record, relying on the unique _id to detect a key that is already taken
+func (s *mongoStore) Claim(record IdempotencyRecord, window time.Duration) (IdempotencyRecord, bool, error) {
+	// Use the existing mongoDBSessionCopy
+	mongoDBSessionCopy := s.session.Copy()
+	defer mongoDBSessionCopy.Close()
+	collection := mongoDBSessionCopy.DB(mongoDatabaseName).C(idempotencyCollectionName)
+
+	// Try twice, an expired key is removed and claimed again
+	for attempt := 0; attempt < 2; attempt++ {
+		err := collection.Insert(record)
+		if err == nil {
+			return record, true, nil
+		}
+		if !mgo.IsDup(err) {
+			return record, false, err
+		}
+
+		var existing IdempotencyRecord
+		err = collection.FindId(record.Key).One(&existing)
+		if err == mgo.ErrNotFound {
+			// Expired between the insert and the find
+			continue
+		}
+		if err != nil {
+			return record, false, err
+		}
+
+		// The TTL index only sweeps every minute or so, so check the window ourselves
+		if record.CreatedAt.Sub(existing.CreatedAt) > window {
+			err = collection.Remove(bson.M{"_id": record.Key, "createdat": existing.CreatedAt})
+			if err != nil && err != mgo.ErrNotFound {
+				return record, false, err
+			}
+			continue
+		}
+
+		return existing, false, nil
+	}
+
+	return record, false, ErrIdempotencyKeyInProgress
+}
+
+// TakeOver updates an expired claim only if it still has the order id and lease it was read with,
+// so of two retries taking over the same key only one succeeds
+func (s *mongoStore) TakeOver(expired IdempotencyRecord, orderID string, leaseUntil time.Time) (bool, error) {
+	// Use the existing mongoDBSessionCopy
+	mongoDBSessionCopy := s.session.Copy()
+	defer mongoDBSessionCopy.Close()
+
+	selector := bson.M{"_id": expired.Key, "orderid": expired.OrderID, "leaseuntil": expired.LeaseUntil}
+	if expired.LeaseUntil.IsZero() {
+		// Keys claimed before leases were recorded have no leaseuntil
+		selector["leaseuntil"] = bson.M{"$in": []interface{}{expired.LeaseUntil, nil}}
+	}
+
+	err := mongoDBSessionCopy.DB(mongoDatabaseName).C(idempotencyCollectionName).
+		Update(selector, bson.M{"$set": bson.M{"orderid": orderID, "leaseuntil": leaseUntil}})
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Complete records the order captured for a claimed key, ending its lease
+func (s *mongoStore) Complete(key string, orderID string) error {
+	// Use the existing mongoDBSessionCopy
+	mongoDBSessionCopy := s.session.Copy()
+	defer mongoDBSessionCopy.Close()
+
+	return mongoDBSessionCopy.DB(mongoDatabaseName).C(idempotencyCollectionName).
+		UpdateId(key, bson.M{"$set": bson.M{"orderid": orderID, "leaseuntil": time.Time{}}})
+}
+
+// Release ends the lease of a claimed key that hasn't been completed, unless another request took it over
+func (s *mongoStore) Release(key string, leaseUntil time.Time) error {
+	// Use the existing mongoDBSessionCopy
+	mongoDBSessionCopy := s.session.Copy()
+	defer mongoDBSessionCopy.Close()
+
+	err := mongoDBSessionCopy.DB(mongoDatabaseName).C(idempotencyCollectionName).
+		Update(bson.M{"_id": key, "leaseuntil": leaseUntil}, bson.M{"$set": bson.M{"leaseuntil": time.Now().UTC()}})
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// trackDependency tracks a MongoDB/CosmosDB call in the custom telemetry, with the request id of ctx if any, and the metrics
+func (s *mongoStore) trackDependency(ctx context.Context, data string, success bool, err error, startTime time.Time, endTime time.Time) {
+	dependency := newDependency(db, "MongoDB", s.url, data, err, startTime, endTime)
+	dependency.Success = success
+	telemetryFor(ctx, customTelemetry).TrackDependency(dependency)
+	observeDependency(dependency)
+}
+
+func initMongoDial(mongoURL string) (*mgo.Session, error) {
+	url, err := url.Parse(mongoURL)
+	if err != nil {
+		customTelemetry.TrackException(err, nil)
+		logging.Fatal("Problem parsing the Mongo URL", "url", mongoURL, "error", err)
+	}
+
+	if isCosmosDb {
+		logging.Info("Using CosmosDB")
+		db = "CosmosDB"
+
+	} else {
+		logging.Info("Using MongoDB")
+		db = "MongoDB"
+	}
+
+	dialInfo := mongoDialInfo(url)
+
+	// Create a mongoDBSession which maintains a pool of socket connections
+	// to our MongoDB.
+	startTime := time.Now()
+
+	logging.Info("Attempting to connect to MongoDB")
+	mongoDBSession, mongoDBSessionError := mgo.DialWithInfo(dialInfo)
+	if mongoDBSessionError != nil {
+		logging.Error("Can't connect to mongo", "url", mongoURL, "error", mongoDBSessionError)
+		customTelemetry.TrackException(mongoDBSessionError, nil)
+	} else {
+		logging.Info("Connected to MongoDB")
+
+		mongoDBSession.SetMode(mgo.Monotonic, true)
+
+		// Limit connection pool to avoid running into Request Rate Too Large on CosmosDB
+		mongoDBSession.SetPoolLimit(mongoPoolLimit)
+	}
+
+	endTime := time.Now()
+
+	// Track the dependency
+	dependency := newDependency(db, "MongoDB", mongoURL, "Create session", mongoDBSessionError, startTime, endTime)
+	customTelemetry.TrackDependency(dependency)
+	observeDependency(dependency)
+	return mongoDBSession, mongoDBSessionError
+}
+
+// mongoDialInfo extracts the components of the URL because the MongoDB driver is peculiar, and logs them without the password
+func mongoDialInfo(url *url.URL) *mgo.DialInfo {
+	var dialInfo *mgo.DialInfo
+	mongoUsername := ""
+	mongoPassword := ""
+	if url.User != nil {
+		mongoUsername = url.User.Username()
+		mongoPassword, _ = url.User.Password()
+	}
+	mongoHost := url.Host
+	mongoDatabase := mongoDatabaseName // can be anything
+	mongoSSL := strings.Contains(url.RawQuery, "ssl=true")
+
+	logging.Info("MongoDB", "username", mongoUsername, "host", mongoHost, "database", mongoDatabase, "ssl", mongoSSL)
+
+	if mongoSSL {
+		dialInfo = &mgo.DialInfo{
+			Addrs:    []string{mongoHost},
+			Timeout:  10 * time.Second,
+			Database: mongoDatabase, // It can be anything
+			Username: mongoUsername, // Username
+			Password: mongoPassword, // Password
+			DialServer: func(addr *mgo.ServerAddr) (net.Conn, error) {
+				return tls.Dial("tcp", addr.String(), &tls.Config{})
+			},
+		}
+	} else {
+		dialInfo = &mgo.DialInfo{
+			Addrs:    []string{mongoHost},
+			Timeout:  10 * time.Second,
+			Database: mongoDatabase, // It can be anything
+			Username: mongoUsername, // Username
+			Password: mongoPassword, // Password
+		}
+	}
+	return dialInfo
+}
+
+// initCollections shards the orders collection and creates the indexes
+func (s *mongoStore) initCollections() {
+	mongoDBSessionCopy := s.session.Copy()
+	defer mongoDBSessionCopy.Close()
+
+	// SetSafe changes the mongoDBSessionCopy safety mode.
+	// If the safe parameter is nil, the mongoDBSessionCopy is put in unsafe mode, and writes become fire-and-forget,
+	// without error checking. The unsafe mode is faster since operations won't hold on waiting for a confirmation.
+	// http://godoc.org/labix.org/v2/mgo#Session.SetMode.
+	mongoDBSessionCopy.SetSafe(nil)
+
+	// The order id is only unique within a partition, a unique index on the sharded collection has to start with the
+	// shard key. Each id maps to a single partition so it is unique across the collection. CosmosDB only creates unique
+	// indexes on an empty collection, on an existing one ErrDuplicateOrder is left to the ids being unique.
+	err := mongoDBSessionCopy.DB(mongoDatabaseName).C(mongoCollectionName).EnsureIndex(mgo.Index{
+		Key:    []string{mongoCollectionShardKey, "orderid"},
+		Unique: true,
+	})
+	if err != nil {
+		trackException(context.Background(), err)
+		logging.Warn("Could not create the unique partition and orderid index", "error", err)
+	}
+
+	// Orders are looked up and paged through by their id
+	if err := mongoDBSessionCopy.DB(mongoDatabaseName).C(mongoCollectionName).EnsureIndexKey("orderid"); err != nil {
+		trackException(context.Background(), err)
+		logging.Warn("Could not create the orderid index", "error", err)
+	}
+
+	// The outbox relay looks for orders with pending events
+	if err := mongoDBSessionCopy.DB(mongoDatabaseName).C(mongoCollectionName).EnsureIndexKey("outbox.state"); err != nil {
+		trackException(context.Background(), err)
+		logging.Warn("Could not create the outbox index", "error", err)
+	}
+
+	// Let MongoDB expire old Idempotency-Keys
+	err = mongoDBSessionCopy.DB(mongoDatabaseName).C(idempotencyCollectionName).EnsureIndex(mgo.Index{
+		Key:         []string{"createdat"},
+		ExpireAfter: idempotencyWindow,
+	})
+	if err != nil {
+		// Most likely the index exists with a different window, keys are still checked against the current one
+		trackException(context.Background(), err)
+		logging.Warn("Could not create the idempotency key TTL index", "error", err)
+	}
+
+	// Create a sharded collection and retrieve it
+	result := bson.M{}
+	err = mongoDBSessionCopy.DB(mongoDatabaseName).Run(
+		bson.D{
+			{
+				"shardCollection",
+				fmt.Sprintf("%s.%s", mongoDatabaseName, mongoCollectionName),
+			},
+			{
+				"key",
+				bson.M{
+					mongoCollectionShardKey: "hashed",
+				},
+			},
+		}, &result)
+
+	if err != nil {
+		trackException(context.Background(), err)
+		// The collection is most likely created and already sharded. I couldn't find a more elegant way to check this.
+		logging.Warn("Could not create/re-create sharded MongoDB collection. Either collection is already sharded or sharding is not supported. You can ignore this error", "error", err)
+	} else {
+		logging.Info("Created MongoDB collection", "result", result)
+	}
+}
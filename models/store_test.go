@@ -0,0 +1,66 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// forEachStore runs the test against the memory store, and against MongoDB if MONGO_TEST_URL is set.
+// The MongoDB store uses a database of its own which is dropped afterwards.
+func forEachStore(t *testing.T, test func(t *testing.T, store Store)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, newMemoryStore())
+	})
+
+	t.Run("mongo", func(t *testing.T) {
+		mongoURL := os.Getenv("MONGO_TEST_URL")
+		if mongoURL == "" {
+			t.Skip("Set MONGO_TEST_URL to run the test against MongoDB")
+		}
+
+		defer func(name string) { mongoDatabaseName = name }(mongoDatabaseName)
+		mongoDatabaseName = fmt.Sprintf("captureorder_test_%d", time.Now().UnixNano())
+
+		store, err := newMongoStore(mongoURL)
+		if err != nil {
+			t.Fatalf("Could not connect to %s: %v", mongoURL, err)
+		}
+		defer store.session.Close()
+		defer store.session.DB(mongoDatabaseName).DropDatabase()
+
+		test(t, store)
+	})
+}
+
+func TestStoreRejectsDuplicateOrderID(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		order := newTestOrder("test@domain.com", time.Now())
+		order.Partition = orderPartition(order.OrderID)
+
+		if err := store.Create(ctx, order); err != nil {
+			t.Fatalf("Create returned %v", err)
+		}
+		if err := store.Create(ctx, order); err != ErrDuplicateOrder {
+			t.Errorf("Creating the same order twice returned %v, expected ErrDuplicateOrder", err)
+		}
+
+		// The partition doesn't make the same id another order
+		order.Partition = "partition-other"
+		if err := store.Create(ctx, order); err != ErrDuplicateOrder {
+			t.Errorf("Creating the same order in another partition returned %v, expected ErrDuplicateOrder", err)
+		}
+
+		other := order
+		other.OrderID = bson.NewObjectId().Hex()
+		other.Partition = orderPartition(other.OrderID)
+		if err := store.Create(ctx, other); err != nil {
+			t.Errorf("Creating another order returned %v", err)
+		}
+	})
+}
@@ -0,0 +1,207 @@
+package models
+
+import (
+	"context"
+	"os"
+	"strings"
+	"time"
+
+	"captureorderfd/logging"
+)
+
+// Telemetry receives the events, dependency calls, exceptions and metrics the service reports.
+// Implementations must be safe for concurrent use.
+type Telemetry interface {
+	TrackEvent(name string, properties map[string]string)
+	TrackDependency(dependency Dependency)
+	TrackException(err error, properties map[string]string)
+	TrackMetric(name string, value float64, properties map[string]string)
+}
+
+// Dependency is a call to MongoDB/CosmosDB or the AMQP broker
+type Dependency struct {
+	Name       string // CosmosDB, MongoDB, RabbitMQ, ServiceBus...
+	Type       string // MongoDB or AMQP
+	Target     string
+	Data       string // what was done, e.g. Insert order
+	Success    bool
+	ResultCode string // the error, if any
+	Start      time.Time
+	End        time.Time
+	Properties map[string]string
+}
+
+// Telemetry sinks, set with the TELEMETRY environment variable
+const (
+	TelemetryAppInsights = "appinsights"
+	TelemetryStdout      = "stdout"
+)
+
+// Telemetry sinks in use. Override with the TELEMETRY environment variable, a comma separated list of sinks
+var telemetrySinks = []string{TelemetryAppInsights}
+
+// The challenge telemetry goes to the proctors, the custom telemetry to the team.
+// Both discard everything until Setup configures them.
+var challengeTelemetry Telemetry = noopTelemetry{}
+var customTelemetry Telemetry = noopTelemetry{}
+
+// initTelemetry configures the challenge and custom telemetry.
+// The challenge telemetry always goes to the CHALLENGEAPPINSIGHTS_KEY Application Insights resource.
+// The custom telemetry goes to every sink of TELEMETRY: the APPINSIGHTS_KEY Application Insights resource, if provided,
+// and JSON lines on stdout.
+func initTelemetry() {
+	if sinks := os.Getenv("TELEMETRY"); sinks != "" {
+		telemetrySinks = strings.Split(sinks, ",")
+	}
+
+	challengeTelemetry = newAppInsightsTelemetry(challengeInsightsKey)
+
+	var custom []Telemetry
+	for _, sink := range telemetrySinks {
+		switch strings.ToLower(strings.TrimSpace(sink)) {
+		case TelemetryAppInsights:
+			if customInsightsKey != "" {
+				custom = append(custom, newAppInsightsTelemetry(customInsightsKey))
+			}
+		case TelemetryStdout:
+			custom = append(custom, newJSONTelemetry(os.Stdout))
+		case "":
+		default:
+			logging.Warn("Unknown telemetry sink", "sink", sink, "use", TelemetryAppInsights+" or "+TelemetryStdout)
+		}
+	}
+	customTelemetry = newMultiTelemetry(custom...)
+	logging.Info("Sending telemetry. You can override by setting the TELEMETRY environment variable to a comma separated list of "+TelemetryAppInsights+" and "+TelemetryStdout+".", "sinks", strings.Join(telemetrySinks, ","))
+}
+
+// noopTelemetry discards everything
+type noopTelemetry struct{}
+
+func (noopTelemetry) TrackEvent(name string, properties map[string]string)                 {}
+func (noopTelemetry) TrackDependency(dependency Dependency)                                {}
+func (noopTelemetry) TrackException(err error, properties map[string]string)               {}
+func (noopTelemetry) TrackMetric(name string, value float64, properties map[string]string) {}
+
+// multiTelemetry hands everything to each of its sinks
+type multiTelemetry []Telemetry
+
+// newMultiTelemetry fans out to the sinks, or discards everything when there are none
+func newMultiTelemetry(sinks ...Telemetry) Telemetry {
+	switch len(sinks) {
+	case 0:
+		return noopTelemetry{}
+	case 1:
+		return sinks[0]
+	}
+	return multiTelemetry(sinks)
+}
+
+// TrackEvent tracks the event in every sink
+func (m multiTelemetry) TrackEvent(name string, properties map[string]string) {
+	for _, sink := range m {
+		sink.TrackEvent(name, properties)
+	}
+}
+
+// TrackDependency tracks the dependency call in every sink
+func (m multiTelemetry) TrackDependency(dependency Dependency) {
+	for _, sink := range m {
+		sink.TrackDependency(dependency)
+	}
+}
+
+// TrackException tracks the exception in every sink
+func (m multiTelemetry) TrackException(err error, properties map[string]string) {
+	for _, sink := range m {
+		sink.TrackException(err, properties)
+	}
+}
+
+// TrackMetric tracks the metric in every sink
+func (m multiTelemetry) TrackMetric(name string, value float64, properties map[string]string) {
+	for _, sink := range m {
+		sink.TrackMetric(name, value, properties)
+	}
+}
+
+// requestTelemetry adds the id of the request that caused them to the properties of the items
+type requestTelemetry struct {
+	telemetry Telemetry
+	requestID string
+}
+
+// telemetryFor returns telemetry tagging every item with the request id of ctx, if any
+func telemetryFor(ctx context.Context, telemetry Telemetry) Telemetry {
+	requestID := logging.RequestID(ctx)
+	if requestID == "" {
+		return telemetry
+	}
+	return requestTelemetry{telemetry: telemetry, requestID: requestID}
+}
+
+// TrackEvent tracks the event with the request id
+func (r requestTelemetry) TrackEvent(name string, properties map[string]string) {
+	r.telemetry.TrackEvent(name, r.properties(properties))
+}
+
+// TrackDependency tracks the dependency call with the request id
+func (r requestTelemetry) TrackDependency(dependency Dependency) {
+	dependency.Properties = r.properties(dependency.Properties)
+	r.telemetry.TrackDependency(dependency)
+}
+
+// TrackException tracks the exception with the request id
+func (r requestTelemetry) TrackException(err error, properties map[string]string) {
+	r.telemetry.TrackException(err, r.properties(properties))
+}
+
+// TrackMetric tracks the metric with the request id
+func (r requestTelemetry) TrackMetric(name string, value float64, properties map[string]string) {
+	r.telemetry.TrackMetric(name, value, r.properties(properties))
+}
+
+// properties returns a copy of the properties with the request id
+func (r requestTelemetry) properties(properties map[string]string) map[string]string {
+	tagged := map[string]string{"requestId": r.requestID}
+	for key, value := range properties {
+		tagged[key] = value
+	}
+	return tagged
+}
+
+// trackChallengeEvent tracks one of the order's steps for the challenge, in the challenge and the custom telemetry,
+// with the request id of ctx if any
+func trackChallengeEvent(ctx context.Context, name string, sequence string, eventType string, orderID string) {
+	properties := challengeEventProperties(sequence, eventType, orderID)
+	telemetryFor(ctx, challengeTelemetry).TrackEvent(name, properties)
+	telemetryFor(ctx, customTelemetry).TrackEvent(name, properties)
+}
+
+// challengeEventProperties returns the properties the challenge expects on the events of an order
+func challengeEventProperties(sequence string, eventType string, orderID string) map[string]string {
+	return map[string]string{
+		"team":     teamName,
+		"sequence": sequence,
+		"type":     eventType,
+		"service":  "CaptureOrder",
+		"orderId":  orderID,
+	}
+}
+
+// newDependency describes a dependency call, which succeeded unless there is an error.
+// The credentials of the target are masked.
+func newDependency(name string, dependencyType string, target string, data string, err error, startTime time.Time, endTime time.Time) Dependency {
+	dependency := Dependency{
+		Name:    name,
+		Type:    dependencyType,
+		Target:  logging.Redact(target),
+		Data:    data,
+		Success: err == nil,
+		Start:   startTime,
+		End:     endTime,
+	}
+	if err != nil {
+		dependency.ResultCode = err.Error()
+	}
+	return dependency
+}
@@ -0,0 +1,73 @@
+package models
+
+import (
+	"errors"
+
+	"captureorderfd/logging"
+
+	"github.com/Microsoft/ApplicationInsights-Go/appinsights"
+)
+
+// appInsightsTelemetry sends the telemetry to an Application Insights resource
+type appInsightsTelemetry struct {
+	client appinsights.TelemetryClient
+}
+
+// newAppInsightsTelemetry creates a client for the instrumentation key
+func newAppInsightsTelemetry(instrumentationKey string) *appInsightsTelemetry {
+	client := appinsights.NewTelemetryClient(instrumentationKey)
+
+	// Set role instance name globally -- this is usually the
+	// name of the service submitting the telemetry
+	client.Context().Tags.Cloud().SetRole("captureorder_golang")
+	return &appInsightsTelemetry{client: client}
+}
+
+// TrackEvent tracks a custom event
+func (t *appInsightsTelemetry) TrackEvent(name string, properties map[string]string) {
+	event := appinsights.NewEventTelemetry(name)
+	for key, value := range properties {
+		event.Properties[key] = value
+	}
+	t.client.Track(event)
+}
+
+// TrackDependency tracks a remote dependency
+func (t *appInsightsTelemetry) TrackDependency(dependency Dependency) {
+	remote := appinsights.NewRemoteDependencyTelemetry(
+		dependency.Name,
+		dependency.Type,
+		dependency.Target,
+		dependency.Success)
+	remote.Data = dependency.Data
+	remote.ResultCode = dependency.ResultCode
+	remote.MarkTime(dependency.Start, dependency.End)
+	for key, value := range dependency.Properties {
+		remote.Properties[key] = value
+	}
+	t.client.Track(remote)
+}
+
+// TrackException tracks the error as an exception
+func (t *appInsightsTelemetry) TrackException(err error, properties map[string]string) {
+	t.client.Track(newExceptionTelemetry(err, properties))
+}
+
+// newExceptionTelemetry describes the error with its secrets masked, as the JSON telemetry and the logs do.
+// Errors of the MongoDB and AMQP clients can hold URLs with their credentials.
+func newExceptionTelemetry(err error, properties map[string]string) *appinsights.ExceptionTelemetry {
+	exception := appinsights.NewExceptionTelemetry(errors.New(logging.Redact(err.Error())))
+	for key, value := range properties {
+		exception.Properties[key] = value
+	}
+	return exception
+}
+
+// TrackMetric tracks a metric
+func (t *appInsightsTelemetry) TrackMetric(name string, value float64, properties map[string]string) {
+	metric := appinsights.NewMetricTelemetry(name, value)
+	for key, value := range properties {
+		metric.Properties[key] = value
+	}
+	t.client.Track(metric)
+}
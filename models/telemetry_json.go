@@ -0,0 +1,77 @@
+package models
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"captureorderfd/logging"
+)
+
+// jsonTelemetry writes the telemetry as JSON lines, e.g. to stdout for a log collector
+type jsonTelemetry struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+}
+
+// jsonTelemetryItem is one line, the fields that don't apply to its type are left out
+type jsonTelemetryItem struct {
+	Time           time.Time         `json:"time"`
+	Type           string            `json:"type"` // event, dependency, exception or metric
+	Name           string            `json:"name,omitempty"`
+	Properties     map[string]string `json:"properties,omitempty"`
+	DependencyType string            `json:"dependencyType,omitempty"`
+	Target         string            `json:"target,omitempty"`
+	Data           string            `json:"data,omitempty"`
+	Success        *bool             `json:"success,omitempty"`
+	ResultCode     string            `json:"resultCode,omitempty"`
+	DurationMs     *float64          `json:"durationMs,omitempty"`
+	Message        string            `json:"message,omitempty"`
+	Value          *float64          `json:"value,omitempty"`
+}
+
+// newJSONTelemetry writes to w
+func newJSONTelemetry(w io.Writer) *jsonTelemetry {
+	return &jsonTelemetry{encoder: json.NewEncoder(w)}
+}
+
+// TrackEvent writes {"type": "event", "name": ..., "properties": ...}
+func (t *jsonTelemetry) TrackEvent(name string, properties map[string]string) {
+	t.write(jsonTelemetryItem{Time: time.Now().UTC(), Type: "event", Name: name, Properties: properties})
+}
+
+// TrackDependency writes {"type": "dependency", "name": ..., "success": ..., "durationMs": ...}
+func (t *jsonTelemetry) TrackDependency(dependency Dependency) {
+	success := dependency.Success
+	duration := float64(dependency.End.Sub(dependency.Start)) / float64(time.Millisecond)
+	t.write(jsonTelemetryItem{
+		Time:           dependency.Start.UTC(),
+		Type:           "dependency",
+		Name:           dependency.Name,
+		DependencyType: dependency.Type,
+		Target:         dependency.Target,
+		Data:           dependency.Data,
+		Success:        &success,
+		ResultCode:     dependency.ResultCode,
+		DurationMs:     &duration,
+		Properties:     dependency.Properties,
+	})
+}
+
+// TrackException writes {"type": "exception", "message": ...}
+func (t *jsonTelemetry) TrackException(err error, properties map[string]string) {
+	t.write(jsonTelemetryItem{Time: time.Now().UTC(), Type: "exception", Message: logging.Redact(err.Error()), Properties: properties})
+}
+
+// TrackMetric writes {"type": "metric", "name": ..., "value": ...}
+func (t *jsonTelemetry) TrackMetric(name string, value float64, properties map[string]string) {
+	t.write(jsonTelemetryItem{Time: time.Now().UTC(), Type: "metric", Name: name, Value: &value, Properties: properties})
+}
+
+// write writes one line, lines of concurrent calls don't interleave
+func (t *jsonTelemetry) write(item jsonTelemetryItem) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.encoder.Encode(item)
+}
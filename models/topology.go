@@ -0,0 +1,211 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+
+	amqp091 "github.com/streadway/amqp"
+)
+
+// Default RabbitMQ queue, also the routing key when publishing to the default exchange
+const defaultAMQPQueue = "order"
+
+// amqpTopology is where RabbitMQ messages go: an exchange, the queue declared and bound to it,
+// and the routing key of every message. It is read from the AMQP_* environment variables.
+type amqpTopology struct {
+	Exchange     string // empty for the default exchange
+	ExchangeType string // direct, topic, fanout or headers
+	Queue        string
+	QueueArgs    amqp091.Table
+	Bindings     []amqpBinding
+	RoutingKey   *template.Template
+
+	// Dead letters are published to a fanout exchange bound to a single queue, no dead letter exchange when empty
+	DeadLetterExchange string
+	DeadLetterQueue    string
+}
+
+// amqpBinding binds the queue to the exchange, with a routing key or, for a headers exchange, header arguments
+type amqpBinding struct {
+	Key  string
+	Args amqp091.Table
+}
+
+// loadAMQPTopology reads the topology from the environment:
+//
+//	AMQP_EXCHANGE       exchange to publish to, the default exchange when empty
+//	AMQP_EXCHANGE_TYPE  direct (default), topic, fanout or headers
+//	AMQP_ROUTING_KEY    text/template of the routing key, e.g. order.{{.Product}}.{{.Status}}
+//	AMQP_QUEUE          queue to declare and bind, order by default
+//	AMQP_QUEUE_ARGS     queue arguments, e.g. x-queue-type=quorum,x-message-ttl=60000
+//	AMQP_BINDINGS       ; separated binding keys, e.g. order.*.Confirmed;order.Widget.#
+//	                    or, for a headers exchange, header arguments, e.g. x-match=any,Product=Widget
+//	AMQP_DEADLETTER_EXCHANGE  exchange for the events that could not be published, none by default
+//	AMQP_DEADLETTER_QUEUE     queue bound to it, the queue name followed by .deadletter by default
+func loadAMQPTopology() (amqpTopology, error) {
+	topology := amqpTopology{
+		Exchange:           os.Getenv("AMQP_EXCHANGE"),
+		ExchangeType:       strings.ToLower(os.Getenv("AMQP_EXCHANGE_TYPE")),
+		Queue:              os.Getenv("AMQP_QUEUE"),
+		DeadLetterExchange: os.Getenv("AMQP_DEADLETTER_EXCHANGE"),
+		DeadLetterQueue:    os.Getenv("AMQP_DEADLETTER_QUEUE"),
+	}
+	if topology.Queue == "" {
+		topology.Queue = defaultAMQPQueue
+	}
+	if topology.DeadLetterQueue == "" {
+		topology.DeadLetterQueue = topology.Queue + ".deadletter"
+	}
+
+	switch topology.ExchangeType {
+	case "":
+		topology.ExchangeType = amqp091.ExchangeDirect
+	case amqp091.ExchangeDirect, amqp091.ExchangeTopic, amqp091.ExchangeFanout, amqp091.ExchangeHeaders:
+	default:
+		return topology, fmt.Errorf("unknown AMQP_EXCHANGE_TYPE %q, use direct, topic, fanout or headers", topology.ExchangeType)
+	}
+
+	var err error
+	if topology.QueueArgs, err = parseAMQPArgs(os.Getenv("AMQP_QUEUE_ARGS"), true); err != nil {
+		return topology, fmt.Errorf("AMQP_QUEUE_ARGS: %v", err)
+	}
+
+	// The default exchange routes on the queue name
+	routingKey := os.Getenv("AMQP_ROUTING_KEY")
+	if routingKey == "" || topology.Exchange == "" {
+		routingKey = topology.Queue
+	}
+	if topology.RoutingKey, err = template.New("routingKey").Option("missingkey=zero").Parse(routingKey); err != nil {
+		return topology, fmt.Errorf("AMQP_ROUTING_KEY: %v", err)
+	}
+
+	// Every queue is bound to the default exchange already
+	if topology.Exchange == "" {
+		return topology, nil
+	}
+
+	bindings := os.Getenv("AMQP_BINDINGS")
+	if bindings == "" {
+		topology.Bindings = []amqpBinding{topology.defaultBinding()}
+		return topology, nil
+	}
+	for _, binding := range strings.Split(bindings, ";") {
+		if topology.ExchangeType != amqp091.ExchangeHeaders {
+			topology.Bindings = append(topology.Bindings, amqpBinding{Key: strings.TrimSpace(binding)})
+			continue
+		}
+		// Message headers are strings, so the arguments must be too
+		args, err := parseAMQPArgs(binding, false)
+		if err != nil {
+			return topology, fmt.Errorf("AMQP_BINDINGS: %v", err)
+		}
+		topology.Bindings = append(topology.Bindings, amqpBinding{Args: args})
+	}
+	return topology, nil
+}
+
+// defaultBinding binds the queue so it receives every message
+func (t amqpTopology) defaultBinding() amqpBinding {
+	switch t.ExchangeType {
+	case amqp091.ExchangeTopic:
+		return amqpBinding{Key: "#"}
+	case amqp091.ExchangeHeaders:
+		// No header to match, so everything matches
+		return amqpBinding{Args: amqp091.Table{"x-match": "all"}}
+	case amqp091.ExchangeDirect:
+		return amqpBinding{Key: t.Queue}
+	}
+	return amqpBinding{}
+}
+
+// declare declares the exchanges and the queues and binds them
+func (t amqpTopology) declare(channel *amqp091.Channel) (amqp091.Queue, error) {
+	if t.Exchange != "" {
+		err := channel.ExchangeDeclare(
+			t.Exchange,     // name
+			t.ExchangeType, // type
+			true,           // durable
+			false,          // auto-deleted
+			false,          // internal
+			false,          // no-wait
+			nil,            // arguments
+		)
+		if err != nil {
+			return amqp091.Queue{}, err
+		}
+	}
+
+	queue, err := channel.QueueDeclare(
+		t.Queue,     // name
+		true,        // durable
+		false,       // delete when unused
+		false,       // exclusive
+		false,       // no-wait
+		t.QueueArgs, // arguments
+	)
+	if err != nil {
+		return queue, err
+	}
+
+	for _, binding := range t.Bindings {
+		if err := channel.QueueBind(queue.Name, binding.Key, t.Exchange, false, binding.Args); err != nil {
+			return queue, err
+		}
+	}
+
+	if t.DeadLetterExchange == "" {
+		return queue, nil
+	}
+	if err := channel.ExchangeDeclare(t.DeadLetterExchange, amqp091.ExchangeFanout, true, false, false, false, nil); err != nil {
+		return queue, err
+	}
+	if _, err := channel.QueueDeclare(t.DeadLetterQueue, true, false, false, false, nil); err != nil {
+		return queue, err
+	}
+	return queue, channel.QueueBind(t.DeadLetterQueue, "", t.DeadLetterExchange, false, nil)
+}
+
+// routingKey renders the routing key template with the message attributes
+func (t amqpTopology) routingKey(attributes map[string]string) (string, error) {
+	if attributes == nil {
+		attributes = map[string]string{}
+	}
+	var key bytes.Buffer
+	if err := t.RoutingKey.Execute(&key, attributes); err != nil {
+		return "", err
+	}
+	return key.String(), nil
+}
+
+// parseAMQPArgs parses comma separated name=value pairs into AMQP arguments.
+// When typed, whole numbers and true/false are sent as such, so x-message-ttl=60000 is an integer.
+func parseAMQPArgs(value string, typed bool) (amqp091.Table, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+
+	args := amqp091.Table{}
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		name := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || name == "" {
+			return nil, fmt.Errorf("%q is not name=value", pair)
+		}
+
+		argument := strings.TrimSpace(parts[1])
+		number, err := strconv.ParseInt(argument, 10, 64)
+		switch {
+		case typed && err == nil:
+			args[name] = number
+		case typed && (argument == "true" || argument == "false"):
+			args[name] = argument == "true"
+		default:
+			args[name] = argument
+		}
+	}
+	return args, nil
+}
@@ -0,0 +1,87 @@
+package models
+
+import (
+	"os"
+	"testing"
+)
+
+func setTopologyEnv(env map[string]string) {
+	for _, name := range []string{"AMQP_EXCHANGE", "AMQP_EXCHANGE_TYPE", "AMQP_ROUTING_KEY", "AMQP_QUEUE", "AMQP_QUEUE_ARGS", "AMQP_BINDINGS"} {
+		os.Setenv(name, env[name])
+	}
+}
+
+func TestLoadAMQPTopologyDefaults(t *testing.T) {
+	setTopologyEnv(nil)
+
+	topology, err := loadAMQPTopology()
+	if err != nil {
+		t.Fatalf("loadAMQPTopology returned %v", err)
+	}
+	if topology.Exchange != "" || topology.Queue != "order" || len(topology.Bindings) != 0 {
+		t.Errorf("Unexpected default topology %+v", topology)
+	}
+	if key, _ := topology.routingKey(map[string]string{"Product": "Widget"}); key != "order" {
+		t.Errorf("The default routing key is %q, expected order", key)
+	}
+}
+
+func TestLoadAMQPTopologyTopic(t *testing.T) {
+	setTopologyEnv(map[string]string{
+		"AMQP_EXCHANGE":      "orders",
+		"AMQP_EXCHANGE_TYPE": "topic",
+		"AMQP_ROUTING_KEY":   "order.{{.Product}}.{{.Status}}",
+		"AMQP_QUEUE":         "team-a",
+		"AMQP_QUEUE_ARGS":    "x-queue-type=quorum, x-message-ttl=60000",
+		"AMQP_BINDINGS":      "order.*.Confirmed;order.Widget.#",
+	})
+	defer setTopologyEnv(nil)
+
+	topology, err := loadAMQPTopology()
+	if err != nil {
+		t.Fatalf("loadAMQPTopology returned %v", err)
+	}
+	if topology.QueueArgs["x-queue-type"] != "quorum" || topology.QueueArgs["x-message-ttl"] != int64(60000) {
+		t.Errorf("Unexpected queue arguments %v", topology.QueueArgs)
+	}
+	if len(topology.Bindings) != 2 || topology.Bindings[1].Key != "order.Widget.#" {
+		t.Errorf("Unexpected bindings %+v", topology.Bindings)
+	}
+
+	key, err := topology.routingKey(map[string]string{"Product": "Widget", "Status": "Open"})
+	if err != nil || key != "order.Widget.Open" {
+		t.Errorf("The routing key is %q (%v), expected order.Widget.Open", key, err)
+	}
+}
+
+func TestLoadAMQPTopologyHeaders(t *testing.T) {
+	setTopologyEnv(map[string]string{
+		"AMQP_EXCHANGE":      "orders",
+		"AMQP_EXCHANGE_TYPE": "headers",
+		"AMQP_BINDINGS":      "x-match=any,Product=Widget,Partition=3",
+	})
+	defer setTopologyEnv(nil)
+
+	topology, err := loadAMQPTopology()
+	if err != nil {
+		t.Fatalf("loadAMQPTopology returned %v", err)
+	}
+	if len(topology.Bindings) != 1 || topology.Bindings[0].Args["Partition"] != "3" {
+		t.Errorf("Unexpected bindings %+v, header arguments must stay strings", topology.Bindings)
+	}
+}
+
+func TestLoadAMQPTopologyErrors(t *testing.T) {
+	defer setTopologyEnv(nil)
+
+	for name, env := range map[string]map[string]string{
+		"exchange type": {"AMQP_EXCHANGE_TYPE": "broadcast"},
+		"queue args":    {"AMQP_QUEUE_ARGS": "x-queue-type"},
+		"routing key":   {"AMQP_EXCHANGE": "orders", "AMQP_ROUTING_KEY": "order.{{.Product"},
+	} {
+		setTopologyEnv(env)
+		if _, err := loadAMQPTopology(); err == nil {
+			t.Errorf("An invalid %s was accepted", name)
+		}
+	}
+}
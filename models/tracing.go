@@ -0,0 +1,156 @@
+package models
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"time"
+
+	"captureorderfd/logging"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Where the spans go. Override with the OTEL_EXPORTER_OTLP_ENDPOINT environment variable, e.g. http://otel-collector:4318,
+// and the TRACING_FILE environment variable, a file the spans are appended to as JSON. Spans are dropped when neither is set.
+var otlpEndpoint = ""
+var tracingFile = ""
+
+// The tracer of the order pipeline, it does nothing until initTracing installs a provider
+var tracer = otel.Tracer("captureorderfd/models")
+
+// The W3C trace context propagator, traceparent and tracestate
+var tracePropagator propagation.TextMapPropagator = propagation.TraceContext{}
+
+// The provider installed by initTracing, if any
+var tracerProvider *sdktrace.TracerProvider
+
+// initTracing installs a tracer provider exporting to OTLP and/or a file.
+// The trace context of the requests is passed on to the events even when nothing is exported.
+func initTracing() {
+	otel.SetTextMapPropagator(tracePropagator)
+
+	otlpEndpoint = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	tracingFile = os.Getenv("TRACING_FILE")
+	logging.Info("OTLP trace endpoint set. You can override by setting the OTEL_EXPORTER_OTLP_ENDPOINT environment variable.", "endpoint", otlpEndpoint)
+	logging.Info("Trace file set. You can override by setting the TRACING_FILE environment variable.", "file", tracingFile)
+
+	var options []sdktrace.TracerProviderOption
+	if otlpEndpoint != "" {
+		// The exporter reads the endpoint, and the other OTEL_EXPORTER_OTLP_* settings, from the environment
+		exporter, err := otlptracehttp.New(context.Background())
+		if err != nil {
+			logging.Error("Can't export traces", "endpoint", otlpEndpoint, "error", err)
+		} else {
+			options = append(options, sdktrace.WithBatcher(exporter))
+		}
+	}
+	if tracingFile != "" {
+		file, err := os.OpenFile(tracingFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			logging.Error("Can't open the trace file", "file", tracingFile, "error", err)
+		} else if exporter, err := stdouttrace.New(stdouttrace.WithWriter(file)); err != nil {
+			logging.Error("Can't export traces", "file", tracingFile, "error", err)
+		} else {
+			options = append(options, sdktrace.WithSyncer(exporter))
+		}
+	}
+	if len(options) == 0 {
+		return
+	}
+
+	options = append(options, sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "captureorder_golang"))))
+	tracerProvider = sdktrace.NewTracerProvider(options...)
+	otel.SetTracerProvider(tracerProvider)
+}
+
+// ShutdownTracing Exports the spans still buffered, waiting at most 5 seconds
+func ShutdownTracing() {
+	if tracerProvider == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tracerProvider.Shutdown(ctx); err != nil {
+		logging.Error("Problem exporting the last spans", "error", err)
+	}
+}
+
+// StartRequestSpan Starts the server span of a request, continuing the trace of its traceparent header if any.
+// End it with EndRequestSpan.
+func StartRequestSpan(r *http.Request, name string) (context.Context, trace.Span) {
+	ctx := tracePropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	return tracer.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.method", r.Method),
+			attribute.String("http.target", r.URL.Path),
+		))
+}
+
+// EndRequestSpan Ends the server span of a request with the status code of the response, 5xx are errors
+func EndRequestSpan(span trace.Span, statusCode int) {
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+	span.SetAttributes(attribute.Int("http.status_code", statusCode))
+	if statusCode >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(statusCode))
+	}
+	span.End()
+}
+
+// startStoreSpan starts a client span around a MongoDB/CosmosDB call
+func startStoreSpan(ctx context.Context, operation string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "mongodb"),
+			attribute.String("db.name", db),
+			attribute.String("db.operation", operation),
+		))
+}
+
+// startPublishSpan starts a producer span around the publication of an event,
+// continuing the trace of ctx, the one the event was created in
+func startPublishSpan(ctx context.Context, event OutboxEvent) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "Send "+event.Kind,
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", queueType),
+			attribute.String("messaging.operation", "publish"),
+			attribute.String("messaging.message.id", event.ID),
+		))
+}
+
+// endSpan ends a span, recording the error if any
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// injectTraceContext returns the traceparent and tracestate of the span in ctx, or nil if there is none
+func injectTraceContext(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	tracePropagator.Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
+
+// extractTraceContext returns a copy of ctx holding the span of the traceparent and tracestate
+func extractTraceContext(ctx context.Context, traceContext map[string]string) context.Context {
+	return tracePropagator.Extract(ctx, propagation.MapCarrier(traceContext))
+}
@@ -0,0 +1,63 @@
+package models
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestOrderIsTracedFromRequestToMessage(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	defer func(original trace.Tracer) { tracer = original }(tracer)
+	tracer = provider.Tracer("test")
+
+	orderStore = newMemoryStore()
+	publisher = newMemoryPublisher(1)
+	defer func() { publisher = nil }()
+
+	request := httptest.NewRequest("POST", "/v1/order", nil)
+	request.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, span := StartRequestSpan(request, "POST /v1/order")
+	order, err := AddOrder(ctx, Order{EmailAddress: "test@domain.com"}, "")
+	EndRequestSpan(span, 200)
+	if err != nil {
+		t.Fatalf("AddOrder returned %v", err)
+	}
+
+	relayOutbox()
+	msg := <-MemoryMessages()
+
+	spans := recorder.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("Recorded %d spans, expected the request, the insert and the send", len(spans))
+	}
+	server, insert, send := spans[1], spans[0], spans[2]
+	if server.Name() != "POST /v1/order" || server.Parent().SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("The server span %s doesn't continue the traceparent of the request, its parent is %s", server.Name(), server.Parent().SpanID())
+	}
+	for _, child := range []sdktrace.ReadOnlySpan{insert, send} {
+		if child.SpanContext().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || child.Parent().SpanID() != server.SpanContext().SpanID() {
+			t.Errorf("%s is not a child of the server span", child.Name())
+		}
+	}
+	if insert.Name() != "Insert order" || send.Name() != "Send OrderCreated" || send.SpanKind() != trace.SpanKindProducer {
+		t.Errorf("Unexpected spans %s and %s", insert.Name(), send.Name())
+	}
+
+	traceparent, _ := msg.Headers["traceparent"].(string)
+	if msg.OrderID != order.OrderID || !strings.Contains(traceparent, send.SpanContext().SpanID().String()) {
+		t.Errorf("The message has traceparent %q, expected the send span %s", traceparent, send.SpanContext().SpanID())
+	}
+}
+
+func TestEventsCarryNoTraceWithoutOne(t *testing.T) {
+	if traceContext := injectTraceContext(extractTraceContext(context.Background(), nil)); traceContext != nil {
+		t.Errorf("Injected %v without a span", traceContext)
+	}
+}
@@ -0,0 +1,231 @@
+package models
+
+import (
+	"fmt"
+	"net/mail"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// FieldError describes why a single field of a request is invalid
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists every invalid field of a request
+type ValidationError struct {
+	Fields []FieldError `json:"fields"`
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Fields))
+	for i, field := range e.Fields {
+		messages[i] = field.Field + " " + field.Message
+	}
+	return "validation failed: " + strings.Join(messages, ", ")
+}
+
+// Validate checks a request struct against the validation tags on its fields and
+// returns a *ValidationError listing every invalid field, or nil.
+//
+// The supported tags are:
+//
+//	required:"true"   the field must not be its zero value
+//	maxLength:"n"     a string field must be at most n characters
+//	min:"n"           a number field must be at least n
+//	format:"email"    a string field must be a single email address
+//	format:"bcp47"    a string field must be a well-formed BCP 47 language tag
+//
+// Empty optional fields are not checked any further.
+func Validate(request interface{}) error {
+	value := reflect.Indirect(reflect.ValueOf(request))
+	if value.Kind() != reflect.Struct {
+		return fmt.Errorf("can't validate a %s", value.Kind())
+	}
+
+	var fields []FieldError
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		if message := validateField(field, value.Field(i)); message != "" {
+			fields = append(fields, FieldError{Field: field.Name, Message: message})
+		}
+	}
+
+	if len(fields) > 0 {
+		return &ValidationError{Fields: fields}
+	}
+	return nil
+}
+
+// validateField returns why a field is invalid, or an empty string
+func validateField(field reflect.StructField, value reflect.Value) string {
+	if isZero(value) {
+		if field.Tag.Get("required") == "true" {
+			return "is required"
+		}
+		return ""
+	}
+
+	if maxLength := field.Tag.Get("maxLength"); maxLength != "" && value.Kind() == reflect.String {
+		if max, err := strconv.Atoi(maxLength); err == nil && utf8.RuneCountInString(value.String()) > max {
+			return fmt.Sprintf("must be at most %d characters", max)
+		}
+	}
+
+	if min := field.Tag.Get("min"); min != "" && value.Kind() == reflect.Float64 {
+		if minValue, err := strconv.ParseFloat(min, 64); err == nil && value.Float() < minValue {
+			return "must be at least " + min
+		}
+	}
+
+	switch field.Tag.Get("format") {
+	case "email":
+		if !isEmailAddress(value.String()) {
+			return "must be a valid email address"
+		}
+	case "bcp47":
+		if !isLanguageTag(value.String()) {
+			return "must be a BCP 47 language tag such as en or en-US"
+		}
+	}
+
+	return ""
+}
+
+// isZero tells whether a field was left empty
+func isZero(value reflect.Value) bool {
+	switch value.Kind() {
+	case reflect.String:
+		return strings.TrimSpace(value.String()) == ""
+	case reflect.Float32, reflect.Float64:
+		return value.Float() == 0
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return value.Int() == 0
+	case reflect.Slice, reflect.Map, reflect.Ptr, reflect.Interface:
+		return value.IsNil()
+	}
+	return false
+}
+
+// isEmailAddress tells whether s is exactly one bare email address, e.g. test@domain.com
+func isEmailAddress(s string) bool {
+	address, err := mail.ParseAddress(s)
+	if err != nil || address.Address != s {
+		return false
+	}
+	// Require a dotted domain, net/mail accepts anything after the @
+	at := strings.LastIndex(s, "@")
+	domain := s[at+1:]
+	return strings.Contains(domain, ".") && !strings.HasPrefix(domain, ".") && !strings.HasSuffix(domain, ".")
+}
+
+// irregularLanguageTags are the grandfathered tags that don't follow the RFC 5646 grammar
+var irregularLanguageTags = map[string]bool{
+	"en-gb-oed": true, "i-ami": true, "i-bnn": true, "i-default": true, "i-enochian": true,
+	"i-hak": true, "i-klingon": true, "i-lux": true, "i-mingo": true, "i-navajo": true,
+	"i-pwn": true, "i-tao": true, "i-tay": true, "i-tsu": true,
+	"sgn-be-fr": true, "sgn-be-nl": true, "sgn-ch-de": true,
+}
+
+// isLanguageTag tells whether s is a well-formed BCP 47 (RFC 5646) language tag.
+// It checks the syntax only, not whether the subtags are registered.
+func isLanguageTag(s string) bool {
+	tag := strings.ToLower(s)
+	if irregularLanguageTags[tag] {
+		return true
+	}
+
+	subtags := strings.Split(tag, "-")
+	for _, subtag := range subtags {
+		if len(subtag) == 0 || len(subtag) > 8 || !isAlphanumeric(subtag) {
+			return false
+		}
+	}
+
+	// privateuse on its own, e.g. x-whatever
+	if subtags[0] == "x" {
+		return isPrivateUse(subtags)
+	}
+
+	// language = 2*3ALPHA ["-" extlang] / 4ALPHA / 5*8ALPHA
+	i := 0
+	if !isAlpha(subtags[i]) || len(subtags[i]) < 2 {
+		return false
+	}
+	if len(subtags[i]) <= 3 {
+		// extlang = 3ALPHA *2("-" 3ALPHA)
+		for n := 0; n < 3 && i+1 < len(subtags) && len(subtags[i+1]) == 3 && isAlpha(subtags[i+1]); n++ {
+			i++
+		}
+	}
+	i++
+
+	// ["-" script] = 4ALPHA
+	if i < len(subtags) && len(subtags[i]) == 4 && isAlpha(subtags[i]) {
+		i++
+	}
+
+	// ["-" region] = 2ALPHA / 3DIGIT
+	if i < len(subtags) && ((len(subtags[i]) == 2 && isAlpha(subtags[i])) || (len(subtags[i]) == 3 && isDigits(subtags[i]))) {
+		i++
+	}
+
+	// *("-" variant) = 5*8alphanum / (DIGIT 3alphanum)
+	for i < len(subtags) && (len(subtags[i]) >= 5 || (len(subtags[i]) == 4 && isDigits(subtags[i][:1]))) {
+		i++
+	}
+
+	// *("-" extension) = singleton 1*("-" (2*8alphanum))
+	for i < len(subtags) && len(subtags[i]) == 1 && subtags[i] != "x" {
+		i++
+		start := i
+		for i < len(subtags) && len(subtags[i]) >= 2 {
+			i++
+		}
+		if i == start {
+			return false
+		}
+	}
+
+	// ["-" privateuse]
+	if i < len(subtags) && subtags[i] == "x" {
+		return isPrivateUse(subtags[i:])
+	}
+
+	return i == len(subtags)
+}
+
+// isPrivateUse tells whether subtags are "x" followed by at least one subtag
+func isPrivateUse(subtags []string) bool {
+	return len(subtags) > 1 && subtags[0] == "x"
+}
+
+func isAlpha(s string) bool {
+	for _, r := range s {
+		if r < 'a' || r > 'z' {
+			return false
+		}
+	}
+	return true
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func isAlphanumeric(s string) bool {
+	for _, r := range s {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') {
+			return false
+		}
+	}
+	return true
+}
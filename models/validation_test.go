@@ -0,0 +1,129 @@
+package models
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIsLanguageTag(t *testing.T) {
+	for _, test := range []struct {
+		tag   string
+		valid bool
+	}{
+		{"en", true},
+		{"en-US", true},
+		{"EN-us", true},
+		{"es-419", true},
+		{"zh-Hant-TW", true},
+		{"zh-yue-HK", true},        // extlang
+		{"zh-abc-def-ghi", true},   // up to three extlangs
+		{"sl-rozaj-biske", true},   // variants
+		{"de-CH-1901", true},       // variant starting with a digit
+		{"en-a-bbb-x-a-ccc", true}, // extension and private use
+		{"x-whatever", true},
+		{"qaa-Qaaa-QM-x-southern", true},
+		{"i-klingon", true}, // grandfathered
+		{"en-GB-oed", true},
+		{"sgn-BE-FR", true},
+		{"", false},
+		{"e", false},
+		{"1en", false},
+		{"en-", false},
+		{"-en", false},
+		{"en--US", false},
+		{"en_US", false},
+		{"en US", false},
+		{"abcdefghi", false}, // subtags are at most 8 characters
+		{"en-US-US", false},
+		{"en-a", false},   // extension without subtags
+		{"en-a-b", false}, // extension subtags are at least 2 characters
+		{"en-x", false},   // private use without subtags
+		{"x", false},
+		{"i-unknown", false},
+		{"fr-ça", false},
+	} {
+		if valid := isLanguageTag(test.tag); valid != test.valid {
+			t.Errorf("isLanguageTag(%q) is %t, expected %t", test.tag, valid, test.valid)
+		}
+	}
+}
+
+func TestIsEmailAddress(t *testing.T) {
+	for _, test := range []struct {
+		address string
+		valid   bool
+	}{
+		{"test@domain.com", true},
+		{"first.last+tag@sub.domain.co.uk", true},
+		{"test@localhost", false}, // net/mail accepts it
+		{"test@domain.", false},
+		{"test@.domain.com", false},
+		{"Test <test@domain.com>", false},
+		{"test@domain.com, other@domain.com", false},
+		{" test@domain.com", false},
+		{"not an email", false},
+		{"@domain.com", false},
+	} {
+		if valid := isEmailAddress(test.address); valid != test.valid {
+			t.Errorf("isEmailAddress(%q) is %t, expected %t", test.address, valid, test.valid)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		request  interface{}
+		expected []FieldError
+	}{
+		{"valid order", Order{EmailAddress: "test@domain.com", PreferredLanguage: "en-US", Total: 9.99}, nil},
+		{"optional fields left empty", &Order{EmailAddress: "test@domain.com"}, nil},
+		{"missing email", Order{}, []FieldError{{"EmailAddress", "is required"}}},
+		{"whitespace only email", Order{EmailAddress: " \t "}, []FieldError{{"EmailAddress", "is required"}}},
+		{"whitespace only language", Order{EmailAddress: "test@domain.com", PreferredLanguage: "  "}, nil},
+		{"negative total", Order{EmailAddress: "test@domain.com", Total: -0.01}, []FieldError{{"Total", "must be at least 0"}}},
+		{"100 runes", Order{EmailAddress: "test@domain.com", Product: strings.Repeat("é", 100)}, nil},
+		{"101 runes", Order{EmailAddress: "test@domain.com", Product: strings.Repeat("é", 101)}, []FieldError{{"Product", "must be at most 100 characters"}}},
+		{"long language tag", Order{EmailAddress: "test@domain.com", PreferredLanguage: "en-" + strings.Repeat("abcdefgh-", 4)}, []FieldError{{"PreferredLanguage", "must be at most 35 characters"}}},
+		{"every field in order", Order{EmailAddress: "test@localhost", PreferredLanguage: "en_US", Total: -1, Source: strings.Repeat("s", 101)}, []FieldError{
+			{"EmailAddress", "must be a valid email address"},
+			{"PreferredLanguage", "must be a BCP 47 language tag such as en or en-US"},
+			{"Total", "must be at least 0"},
+			{"Source", "must be at most 100 characters"},
+		}},
+		{"status change", StatusChange{Reason: strings.Repeat("r", 501)}, []FieldError{
+			{"Status", "is required"},
+			{"Reason", "must be at most 500 characters"},
+		}},
+	} {
+		err := Validate(test.request)
+		if test.expected == nil {
+			if err != nil {
+				t.Errorf("%s: Validate returned %v", test.name, err)
+			}
+			continue
+		}
+
+		validationErr, ok := err.(*ValidationError)
+		if !ok {
+			t.Errorf("%s: Validate returned %v, expected a *ValidationError", test.name, err)
+			continue
+		}
+		if len(validationErr.Fields) != len(test.expected) {
+			t.Errorf("%s: Validate returned %+v, expected %+v", test.name, validationErr.Fields, test.expected)
+			continue
+		}
+		for i, field := range validationErr.Fields {
+			if field != test.expected[i] {
+				t.Errorf("%s: field %d is %+v, expected %+v", test.name, i, field, test.expected[i])
+			}
+		}
+	}
+}
+
+func TestValidateRejectsNonStructs(t *testing.T) {
+	err := Validate("test@domain.com")
+	if _, ok := err.(*ValidationError); err == nil || ok {
+		t.Errorf("Validate of a string returned %v, expected a plain error", err)
+	}
+}
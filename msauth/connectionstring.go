@@ -0,0 +1,129 @@
+package msauth
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// ConnectionString is a Service Bus or Event Hubs connection string, as copied from the Azure portal:
+//
+//	Endpoint=sb://<namespace>.servicebus.windows.net/;SharedAccessKeyName=<policy>;SharedAccessKey=<key>;EntityPath=<queue or hub>
+//
+// A connection string has either a shared access key, to sign tokens with, or a ready made shared access signature.
+type ConnectionString struct {
+	Endpoint              string // sb://<namespace>.servicebus.windows.net/
+	Host                  string // <namespace>.servicebus.windows.net
+	Namespace             string // <namespace>
+	SharedAccessKeyName   string
+	SharedAccessKey       string
+	SharedAccessSignature string // SharedAccessSignature sr=...&sig=...&se=...&skn=...
+	EntityPath            string // optional for connection strings of a whole namespace
+}
+
+// ParseConnectionString parses a connection string. Keys are case insensitive and parts without a value are ignored,
+// as are the parts it doesn't know, e.g. TransportType. The shared access key is used as is, it must not be URL encoded.
+func ParseConnectionString(connectionString string) (*ConnectionString, error) {
+	parts, err := parseKeyValues(connectionString)
+	if err != nil {
+		return nil, fmt.Errorf("msauth: connection string %v", err)
+	}
+
+	cs := &ConnectionString{
+		Endpoint:              parts["endpoint"],
+		SharedAccessKeyName:   parts["sharedaccesskeyname"],
+		SharedAccessKey:       parts["sharedaccesskey"],
+		SharedAccessSignature: parts["sharedaccesssignature"],
+		EntityPath:            parts["entitypath"],
+	}
+	if err := cs.parseEndpoint(); err != nil {
+		return nil, err
+	}
+	if err := cs.validateCredentials(); err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+// parseKeyValues splits Key=Value;Key=Value... into a map of lower case keys to values.
+// Parts without a value are left out.
+func parseKeyValues(text string) (map[string]string, error) {
+	values := map[string]string{}
+	for _, part := range strings.Split(text, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		// Base64 keys end with =, only split on the first one
+		pair := strings.SplitN(part, "=", 2)
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("part %q is not a Key=Value pair", part)
+		}
+		key, value := strings.TrimSpace(pair[0]), strings.TrimSpace(pair[1])
+		if value == "" {
+			continue
+		}
+
+		name := strings.ToLower(key)
+		if _, seen := values[name]; seen {
+			return nil, fmt.Errorf("has %s more than once", key)
+		}
+		values[name] = value
+	}
+	return values, nil
+}
+
+// parseEndpoint checks the endpoint is a sb:// URL and takes the host and namespace from it
+func (cs *ConnectionString) parseEndpoint() error {
+	if cs.Endpoint == "" {
+		return errors.New("msauth: connection string has no Endpoint, e.g. Endpoint=sb://<namespace>.servicebus.windows.net/")
+	}
+
+	endpoint, err := url.Parse(cs.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return fmt.Errorf("msauth: connection string Endpoint %q is not a URL like sb://<namespace>.servicebus.windows.net/", cs.Endpoint)
+	}
+	if endpoint.Scheme != "sb" {
+		return fmt.Errorf("msauth: connection string Endpoint %q must start with sb://", cs.Endpoint)
+	}
+
+	cs.Host = endpoint.Host
+	cs.Namespace = strings.SplitN(endpoint.Hostname(), ".", 2)[0]
+	return nil
+}
+
+// validateCredentials checks there is a complete key, or a signature
+func (cs *ConnectionString) validateCredentials() error {
+	switch {
+	case cs.SharedAccessKeyName != "" && cs.SharedAccessKey == "":
+		return fmt.Errorf("msauth: connection string has the SharedAccessKeyName %s but no SharedAccessKey", cs.SharedAccessKeyName)
+	case cs.SharedAccessKey != "" && cs.SharedAccessKeyName == "":
+		return errors.New("msauth: connection string has a SharedAccessKey but no SharedAccessKeyName, the name of its policy")
+	case strings.Contains(cs.SharedAccessKey, "%"):
+		// Keys are base64, which has no %
+		return errors.New("msauth: connection string SharedAccessKey is URL encoded, use the key as shown in the Azure portal")
+	case cs.SharedAccessKey == "" && cs.SharedAccessSignature == "":
+		return errors.New("msauth: connection string needs a SharedAccessKeyName and SharedAccessKey, or a SharedAccessSignature")
+	}
+	return nil
+}
+
+// Signer returns a Signer for the shared access key of the connection string, with the given options.
+// It fails for connection strings that only have a shared access signature.
+func (cs *ConnectionString) Signer(options ...Option) (Signer, error) {
+	if cs.SharedAccessKey == "" {
+		return nil, errors.New("msauth: connection string has no SharedAccessKey to sign tokens with")
+	}
+	return New(cs.Namespace, cs.SharedAccessKeyName, cs.SharedAccessKey, options...), nil
+}
+
+// KeyRing returns a KeyRing that starts with the shared access key of the connection string, so it can be rotated.
+// It fails for connection strings that only have a shared access signature.
+func (cs *ConnectionString) KeyRing() (*KeyRing, error) {
+	if cs.SharedAccessKey == "" {
+		return nil, errors.New("msauth: connection string has no SharedAccessKey to sign tokens with")
+	}
+	return NewKeyRing(Key{Name: cs.SharedAccessKeyName, Value: cs.SharedAccessKey}), nil
+}
@@ -0,0 +1,67 @@
+package msauth
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseConnectionString(t *testing.T) {
+	cs, err := ParseConnectionString("Endpoint=sb://fooNamespace.servicebus.windows.net/;SharedAccessKeyName=fooSasUsername;SharedAccessKey=Zm9v+YmFy/YmF6=;EntityPath=order;TransportType=Amqp")
+	if err != nil {
+		t.Fatalf("ParseConnectionString returned %v", err)
+	}
+
+	expected := ConnectionString{
+		Endpoint:            "sb://fooNamespace.servicebus.windows.net/",
+		Host:                "fooNamespace.servicebus.windows.net",
+		Namespace:           "fooNamespace",
+		SharedAccessKeyName: "fooSasUsername",
+		SharedAccessKey:     "Zm9v+YmFy/YmF6=",
+		EntityPath:          "order",
+	}
+	if *cs != expected {
+		t.Errorf("Parsed %+v, expected %+v", *cs, expected)
+	}
+
+	signer, err := cs.Signer()
+	if err != nil {
+		t.Fatalf("Signer returned %v", err)
+	}
+	expiry := SignatureExpiry(time.Unix(0, 0), 300*time.Second)
+	if token := signer.Sign(testFooURI, expiry); token != New("fooNamespace", "fooSasUsername", "Zm9v+YmFy/YmF6=").Sign(testFooURI, expiry) {
+		t.Errorf("The token %q is not signed with the key of the connection string", token)
+	}
+}
+
+func TestParseConnectionStringSignature(t *testing.T) {
+	cs, err := ParseConnectionString("endpoint=sb://fooNamespace.servicebus.windows.net/; sharedaccesssignature=SharedAccessSignature sr=foo&sig=bar%3D&se=300&skn=fooSasUsername")
+	if err != nil {
+		t.Fatalf("ParseConnectionString returned %v", err)
+	}
+	if cs.SharedAccessSignature != "SharedAccessSignature sr=foo&sig=bar%3D&se=300&skn=fooSasUsername" || cs.EntityPath != "" {
+		t.Errorf("Unexpected connection string %+v", *cs)
+	}
+	if _, err := cs.Signer(); err == nil {
+		t.Error("A signer was made without a key")
+	}
+}
+
+func TestParseConnectionStringErrors(t *testing.T) {
+	for connectionString, mention := range map[string]string{
+		"SharedAccessKeyName=foo;SharedAccessKey=bar":                                                 "no Endpoint",
+		"Endpoint=https://foo.servicebus.windows.net/;SharedAccessKeyName=foo;SharedAccessKey=bar":    "sb://",
+		"Endpoint=foo;SharedAccessKeyName=foo;SharedAccessKey=bar":                                    "not a URL",
+		"Endpoint=sb://foo.servicebus.windows.net/;SharedAccessKeyName=foo":                           "no SharedAccessKey",
+		"Endpoint=sb://foo.servicebus.windows.net/;SharedAccessKey=bar":                               "no SharedAccessKeyName",
+		"Endpoint=sb://foo.servicebus.windows.net/;SharedAccessKeyName=foo;SharedAccessKey=bar%3D":    "URL encoded",
+		"Endpoint=sb://foo.servicebus.windows.net/":                                                   "needs a SharedAccessKeyName",
+		"Endpoint=sb://foo.servicebus.windows.net/;SharedAccessKeyName=foo;SharedAccessKey":           "not a Key=Value pair",
+		"Endpoint=sb://foo.servicebus.windows.net/;SharedAccessKeyName=foo;sharedaccesskeyname=other": "more than once",
+	} {
+		_, err := ParseConnectionString(connectionString)
+		if err == nil || !strings.Contains(err.Error(), mention) {
+			t.Errorf("Parsing %q returned %v, expected an error about %s", connectionString, err, mention)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package msauth
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrActiveKey is returned when retiring the key that signs
+var ErrActiveKey = errors.New("msauth: the active key can't be retired")
+
+// KeyRing is a Signer for policies whose keys rotate, e.g. between their primary and secondary key.
+// It signs with the active key, and verifies with any key that wasn't retired.
+// Keys can be swapped at any time, it is safe for concurrent use.
+type KeyRing struct {
+	mu       sync.RWMutex
+	active   Key
+	accepted []Key // the keys besides the active one that verify
+	scope    Scope
+}
+
+// NewKeyRing creates a key ring that signs with active, and verifies with active and the other keys
+func NewKeyRing(active Key, others ...Key) *KeyRing {
+	r := &KeyRing{}
+	r.Set(active, others...)
+	return r
+}
+
+// Sign signs the token with the active key, see Signer
+func (r *KeyRing) Sign(uri string, expiry string) string {
+	r.mu.RLock()
+	s := &signer{saKey: r.active.Name, saValue: []byte(r.active.Value), scope: r.scope}
+	r.mu.RUnlock()
+	return s.Sign(uri, expiry)
+}
+
+// SetScope sets which resource the tokens are for, see Scope
+func (r *KeyRing) SetScope(scope Scope) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.scope = scope
+}
+
+// Active returns the key that signs
+func (r *KeyRing) Active() Key {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.active
+}
+
+// Keys returns the keys that verify, the active one first
+func (r *KeyRing) Keys() []Key {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]Key{r.active}, r.accepted...)
+}
+
+// Verify verifies the token with the keys that weren't retired, see Token.Verify
+func (r *KeyRing) Verify(token *Token, resourceURI string, now time.Time) error {
+	return token.Verify(resourceURI, now, r.Keys()...)
+}
+
+// Set replaces all the keys
+func (r *KeyRing) Set(active Key, others ...Key) {
+	accepted := make([]Key, 0, len(others))
+	for _, key := range others {
+		if key != active {
+			accepted = append(accepted, key)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.active = active
+	r.accepted = accepted
+}
+
+// Rotate signs with a new key from now on. The previous active key still verifies until it is retired.
+func (r *KeyRing) Rotate(active Key) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if active == r.active {
+		return
+	}
+
+	accepted := []Key{r.active}
+	for _, key := range r.accepted {
+		if key != active {
+			accepted = append(accepted, key)
+		}
+	}
+	r.active = active
+	r.accepted = accepted
+}
+
+// Retire stops verifying with the key
+func (r *KeyRing) Retire(key Key) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if key == r.active {
+		return ErrActiveKey
+	}
+
+	var accepted []Key
+	for _, k := range r.accepted {
+		if k != key {
+			accepted = append(accepted, k)
+		}
+	}
+	r.accepted = accepted
+	return nil
+}
+
+// LoadFile replaces the keys with the ones in a file, e.g. a mounted secret. The file has one key per line:
+//
+//	SharedAccessKeyName=<policy>;SharedAccessKey=<key>
+//
+// Whole connection strings work too, their other parts are ignored. The first key is the active one,
+// blank lines and lines starting with # are skipped. The keys are left alone when the file is invalid.
+func (r *KeyRing) LoadFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var keys []Key
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		parts, err := parseKeyValues(text)
+		if err != nil {
+			return fmt.Errorf("msauth: %s:%d: %v", path, line, err)
+		}
+		key := Key{Name: parts["sharedaccesskeyname"], Value: parts["sharedaccesskey"]}
+		if key.Name == "" || key.Value == "" {
+			return fmt.Errorf("msauth: %s:%d: needs a SharedAccessKeyName and a SharedAccessKey", path, line)
+		}
+		if strings.Contains(key.Value, "%") {
+			return fmt.Errorf("msauth: %s:%d: SharedAccessKey is URL encoded, use the key as shown in the Azure portal", path, line)
+		}
+		keys = append(keys, key)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("msauth: %s has no keys", path)
+	}
+
+	r.Set(keys[0], keys[1:]...)
+	return nil
+}
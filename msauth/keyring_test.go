@@ -0,0 +1,86 @@
+package msauth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyRingRotation(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	expiry := SignatureExpiry(now, time.Hour)
+	primary := Key{Name: "fooSasUsername", Value: "primary"}
+	secondary := Key{Name: "fooSasUsername", Value: "secondary"}
+
+	ring := NewKeyRing(primary)
+	if token := ring.Sign(testQueueURI, expiry); token != New("fooNamespace", primary.Name, primary.Value).Sign(testQueueURI, expiry) {
+		t.Errorf("The token %q is not signed with the active key", token)
+	}
+	signedWithPrimary, _ := ParseToken(ring.Sign(testQueueURI, expiry))
+
+	ring.Rotate(secondary)
+	signedWithSecondary, _ := ParseToken(ring.Sign(testQueueURI, expiry))
+	if ring.Active() != secondary || len(ring.Keys()) != 2 {
+		t.Fatalf("After rotating, the active key is %v and the keys are %v", ring.Active(), ring.Keys())
+	}
+	for _, token := range []*Token{signedWithPrimary, signedWithSecondary} {
+		if err := ring.Verify(token, testQueueURI, now); err != nil {
+			t.Errorf("Verify returned %v after rotating", err)
+		}
+	}
+
+	if err := ring.Retire(secondary); err != ErrActiveKey {
+		t.Errorf("Retiring the active key returned %v, expected %v", err, ErrActiveKey)
+	}
+	if err := ring.Retire(primary); err != nil {
+		t.Fatalf("Retire returned %v", err)
+	}
+	if err := ring.Verify(signedWithPrimary, testQueueURI, now); err != ErrInvalidSignature {
+		t.Errorf("A token signed with a retired key returned %v, expected %v", err, ErrInvalidSignature)
+	}
+	if err := ring.Verify(signedWithSecondary, testQueueURI, now); err != nil {
+		t.Errorf("Verify returned %v after retiring the previous key", err)
+	}
+}
+
+func TestKeyRingLoadFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "msauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "keys")
+	ioutil.WriteFile(path, []byte(`# rotated on Mondays
+Endpoint=sb://fooNamespace.servicebus.windows.net/;SharedAccessKeyName=send;SharedAccessKey=c2Vjb25kYXJ5=
+
+SharedAccessKeyName=send;SharedAccessKey=cHJpbWFyeQ==
+`), 0600)
+
+	ring := NewKeyRing(Key{Name: "send", Value: "old"})
+	if err := ring.LoadFile(path); err != nil {
+		t.Fatalf("LoadFile returned %v", err)
+	}
+	keys := ring.Keys()
+	if len(keys) != 2 || keys[0] != (Key{Name: "send", Value: "c2Vjb25kYXJ5="}) || keys[1] != (Key{Name: "send", Value: "cHJpbWFyeQ=="}) {
+		t.Errorf("Loaded %v", keys)
+	}
+
+	for content, mention := range map[string]string{
+		"":                           "has no keys",
+		"SharedAccessKeyName=send\n": "needs a SharedAccessKeyName and a SharedAccessKey",
+		"SharedAccessKeyName=send;SharedAccessKey=a%3D\n": "URL encoded",
+		"SharedAccessKeyName=send;garbage\n":              ":1: part",
+	} {
+		ioutil.WriteFile(path, []byte(content), 0600)
+		if err := ring.LoadFile(path); err == nil || !strings.Contains(err.Error(), mention) {
+			t.Errorf("Loading %q returned %v, expected an error about %s", content, err, mention)
+		}
+	}
+	if len(ring.Keys()) != 2 {
+		t.Errorf("An invalid file replaced the keys with %v", ring.Keys())
+	}
+}
@@ -0,0 +1,157 @@
+package msauth
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AccessToken is a signed token along with when it expires, and when the TokenProvider signs a new one
+type AccessToken struct {
+	Token     string // SharedAccessSignature sig=...&se=...&skn=...&sr=...
+	Resource  string // the URI the token was signed for
+	Expiry    time.Time
+	RefreshAt time.Time
+}
+
+// TokenProvider signs tokens and caches them per resource URI. A token is signed again in the background
+// once a fraction of its lifetime has passed, so callers always get a token with time left on it.
+// It is safe for concurrent use. Close stops the background refresh.
+type TokenProvider struct {
+	signer          Signer
+	lifetime        time.Duration
+	refreshFraction float64
+	now             func() time.Time
+
+	mu      sync.Mutex
+	tokens  map[string]AccessToken
+	wake    chan struct{} // a token was added, reschedule the refresh
+	closing chan struct{}
+	once    sync.Once
+}
+
+// NewTokenProvider creates a provider of tokens valid for lifetime, signed again when refreshFraction of it has passed,
+// e.g. 0.8 signs a token valid for an hour again after 48 minutes. The fraction is clamped to (0, 1],
+// and the lifetime is at least a second, the precision of the expiry in tokens.
+func NewTokenProvider(signer Signer, lifetime time.Duration, refreshFraction float64) *TokenProvider {
+	p := newTokenProvider(signer, lifetime, refreshFraction)
+	go p.run()
+	return p
+}
+
+// newTokenProvider creates a provider without starting the background refresh
+func newTokenProvider(signer Signer, lifetime time.Duration, refreshFraction float64) *TokenProvider {
+	if refreshFraction <= 0 || refreshFraction > 1 {
+		refreshFraction = 1
+	}
+	if lifetime < time.Second {
+		lifetime = time.Second
+	}
+
+	return &TokenProvider{
+		signer:          signer,
+		lifetime:        lifetime,
+		refreshFraction: refreshFraction,
+		now:             time.Now,
+		tokens:          map[string]AccessToken{},
+		wake:            make(chan struct{}, 1),
+		closing:         make(chan struct{}),
+	}
+}
+
+// Token returns the cached token for the resource URI, or signs one when there is none or it is due for a refresh
+func (p *TokenProvider) Token(uri string) AccessToken {
+	p.mu.Lock()
+	token, ok := p.tokens[uri]
+	p.mu.Unlock()
+
+	if ok && p.now().Before(token.RefreshAt) {
+		return token
+	}
+	return p.Refresh(uri)
+}
+
+// Refresh signs a new token for the resource URI straight away, e.g. after the signing key changed
+func (p *TokenProvider) Refresh(uri string) AccessToken {
+	token := p.sign(uri)
+
+	p.mu.Lock()
+	_, known := p.tokens[uri]
+	p.tokens[uri] = token
+	p.mu.Unlock()
+
+	if !known {
+		select {
+		case p.wake <- struct{}{}:
+		default:
+		}
+	}
+	return token
+}
+
+// Close stops the background refresh. Token still signs on demand.
+func (p *TokenProvider) Close() {
+	p.once.Do(func() { close(p.closing) })
+}
+
+// sign signs a token for the resource URI, the expiry is rounded to the second like in the token
+func (p *TokenProvider) sign(uri string) AccessToken {
+	issued := p.now()
+	expiry := SignatureExpiry(issued, p.lifetime)
+	seconds, _ := strconv.ParseInt(expiry, 10, 64)
+
+	return AccessToken{
+		Token:     p.signer.Sign(uri, expiry),
+		Resource:  uri,
+		Expiry:    time.Unix(seconds, 0),
+		RefreshAt: issued.Add(time.Duration(float64(p.lifetime) * p.refreshFraction)),
+	}
+}
+
+// run refreshes the tokens as they come due, until Close is called
+func (p *TokenProvider) run() {
+	for {
+		timer := time.NewTimer(p.nextRefresh().Sub(p.now()))
+		select {
+		case <-timer.C:
+			p.refreshDue()
+		case <-p.wake:
+		case <-p.closing:
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+	}
+}
+
+// nextRefresh returns when the first token comes due, or a lifetime from now when there are none
+func (p *TokenProvider) nextRefresh() time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	next := p.now().Add(p.lifetime)
+	for _, token := range p.tokens {
+		if token.RefreshAt.Before(next) {
+			next = token.RefreshAt
+		}
+	}
+	return next
+}
+
+// refreshDue signs the tokens that are due for a refresh again
+func (p *TokenProvider) refreshDue() {
+	now := p.now()
+
+	p.mu.Lock()
+	var due []string
+	for uri, token := range p.tokens {
+		if !now.Before(token.RefreshAt) {
+			due = append(due, uri)
+		}
+	}
+	p.mu.Unlock()
+
+	for _, uri := range due {
+		p.Refresh(uri)
+	}
+}
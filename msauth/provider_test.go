@@ -0,0 +1,97 @@
+package msauth
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingSigner counts the tokens it signs
+type countingSigner struct {
+	mu     sync.Mutex
+	signed int
+	Signer
+}
+
+func (s *countingSigner) Sign(uri string, expiry string) string {
+	s.mu.Lock()
+	s.signed++
+	s.mu.Unlock()
+	return s.Signer.Sign(uri, expiry)
+}
+
+func TestTokenProviderCaches(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	signer := &countingSigner{Signer: New("fooNamespace", "fooSasUsername", "fooSasPassword")}
+	provider := newTokenProvider(signer, time.Hour, 0.75)
+	provider.now = func() time.Time { return now }
+
+	token := provider.Token(testQueueURI)
+	if !token.Expiry.Equal(now.Add(time.Hour)) || !token.RefreshAt.Equal(now.Add(45*time.Minute)) || token.Resource != testQueueURI {
+		t.Errorf("Unexpected token %+v", token)
+	}
+	parsed, err := ParseToken(token.Token)
+	if err != nil || !parsed.Expiry.Equal(token.Expiry) {
+		t.Errorf("The token %q doesn't expire at %v: %v", token.Token, token.Expiry, err)
+	}
+
+	if again := provider.Token(testQueueURI); again != token || signer.signed != 1 {
+		t.Errorf("The token was signed %d times, expected it cached", signer.signed)
+	}
+	provider.Token("https://fooNamespace.servicebus.windows.net/other")
+	if signer.signed != 2 {
+		t.Errorf("Tokens are not cached per resource, %d were signed", signer.signed)
+	}
+
+	// Due for a refresh, even if the background refresh didn't run
+	now = now.Add(45 * time.Minute)
+	if refreshed := provider.Token(testQueueURI); refreshed == token || !refreshed.Expiry.Equal(now.Add(time.Hour)) {
+		t.Errorf("A token due for a refresh was returned: %+v", refreshed)
+	}
+}
+
+func TestTokenProviderRefreshDue(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	signer := &countingSigner{Signer: New("fooNamespace", "fooSasUsername", "fooSasPassword")}
+	provider := newTokenProvider(signer, time.Hour, 0.5)
+	provider.now = func() time.Time { return now }
+
+	first := provider.Token(testQueueURI)
+	now = now.Add(10 * time.Minute)
+	second := provider.Token("https://fooNamespace.servicebus.windows.net/other")
+
+	if next := provider.nextRefresh(); !next.Equal(first.RefreshAt) {
+		t.Errorf("The next refresh is at %v, expected %v", next, first.RefreshAt)
+	}
+
+	now = first.RefreshAt
+	provider.refreshDue()
+	if signer.signed != 3 {
+		t.Errorf("%d tokens were signed, expected only the one due to be signed again", signer.signed)
+	}
+	if token := provider.Token(testQueueURI); !token.Expiry.After(first.Expiry) {
+		t.Errorf("The due token wasn't refreshed: %+v", token)
+	}
+	if token := provider.Token(second.Resource); token != second {
+		t.Errorf("A token that wasn't due was refreshed: %+v", token)
+	}
+}
+
+func TestTokenProviderBackground(t *testing.T) {
+	signer := &countingSigner{Signer: New("fooNamespace", "fooSasUsername", "fooSasPassword")}
+	provider := NewTokenProvider(signer, time.Second, 0.1)
+	defer provider.Close()
+
+	provider.Token(testQueueURI)
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		signer.mu.Lock()
+		signed := signer.signed
+		signer.mu.Unlock()
+		if signed > 1 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("The token wasn't refreshed in the background")
+}
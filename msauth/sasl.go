@@ -1,8 +1,9 @@
 // Package msauth is used to generate a Microsoft SASL signed token
-// to be used across various services provided by Microsoft.
+// to be used across various services provided by Microsoft, and to verify such tokens.
 package msauth
 
 import (
+	"bytes"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
@@ -23,6 +24,28 @@ type signer struct {
 	saKey     string
 	saValue   []byte
 	url       string
+	scope     Scope
+}
+
+// Scope tells which resource the tokens of a Signer are for
+type Scope int
+
+const (
+	// EntityScope signs tokens for the URI passed to Sign, e.g. a queue. This is the default.
+	EntityScope Scope = iota
+	// NamespaceScope signs tokens for the namespace of the URI passed to Sign, e.g. amqp://<namespace>.servicebus.windows.net/,
+	// which are good for all its entities. The policy must be defined on the namespace.
+	NamespaceScope
+)
+
+// Option configures a Signer
+type Option func(*signer)
+
+// WithScope sets which resource the tokens are for, see Scope
+func WithScope(scope Scope) Option {
+	return func(s *signer) {
+		s.scope = scope
+	}
 }
 
 const (
@@ -32,13 +55,17 @@ const (
 // New creates a new auth builder from the given parameters. Their meaning can be found in the MSDN docs at:
 //  https://docs.microsoft.com/en-us/rest/api/servicebus/Introduction
 //  https://docs.microsoft.com/en-us/azure/service-bus-messaging/service-bus-sas
-func New(namespace string, sharedAccessKeyName string, sharedAccessKeyValue string) Signer {
-	return &signer{
+func New(namespace string, sharedAccessKeyName string, sharedAccessKeyValue string, options ...Option) Signer {
+	s := &signer{
 		namespace: namespace,
 		saKey:     sharedAccessKeyName,
 		saValue:   []byte(sharedAccessKeyValue),
 		url:       fmt.Sprintf(serviceBusURL, namespace),
 	}
+	for _, option := range options {
+		option(s)
+	}
+	return s
 }
 
 // Sign returns the value of the Microsoft token that could be used for various Azure services:
@@ -49,6 +76,9 @@ func New(namespace string, sharedAccessKeyName string, sharedAccessKeyValue stri
 // It's translated from the Python client:
 // https://github.com/Azure/azure-sdk-for-python/blob/master/azure-servicebus/azure/servicebus/servicebusservice.py
 func (s *signer) Sign(uri string, expiry string) string {
+	if s.scope == NamespaceScope {
+		uri = namespaceURI(uri)
+	}
 	u := signatureURI(uri)
 	sts := stringToSign(u, expiry)
 	sig := s.signString(sts)
@@ -64,12 +94,52 @@ func SignatureExpiry(from time.Time, interval time.Duration) string {
 	return strconv.Itoa(int(t))
 }
 
-// signatureURI returns the canonical URI according to Azure specs.
+// signatureURI returns the canonical URI according to Azure specs, the sr of the token and the first line of the string to sign:
+//   - the fragment, never sent to the service, is dropped
+//   - every byte of the UTF-8 URI but the RFC 3986 unreserved characters A-Z a-z 0-9 - . _ ~ is percent encoded,
+//     including the / : ? = & of the path and query, and space is %20 rather than +
+//   - the result is lower cased, which lower cases the scheme, the host and the hex digits, and the path too
+//     as Service Bus and Event Hubs entity names are case insensitive. Non ASCII characters are encoded first, so they are kept.
 //
-// It's translated from the Python client:
+// It matches urllib.quote(uri, safe="").lower() of the Python client:
 // https://github.com/Azure/azure-sdk-for-python/blob/master/azure-servicebus/azure/servicebus/servicebusservice.py
+//
+// The C# and JavaScript samples of the Azure documentation differ: HttpUtility.UrlEncode encodes space as + rather than %20,
+// and it leaves ! * ( ) unencoded, as encodeURIComponent does with ! * ' ( ). Their tokens for URIs holding these characters
+// don't match the ones signed here, so entity names are best kept to the unreserved characters.
 func signatureURI(uri string) string {
-	return strings.ToLower(url.QueryEscape(uri)) //Python's urllib.quote and Go's url.QueryEscape behave differently. This might work, or it might not...like everything else to do with authentication in Azure.
+	if i := strings.IndexByte(uri, '#'); i >= 0 {
+		uri = uri[:i]
+	}
+
+	const hex = "0123456789abcdef"
+	var b bytes.Buffer
+	for i := 0; i < len(uri); i++ {
+		c := uri[i]
+		if isUnreserved(c) {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hex[c>>4])
+		b.WriteByte(hex[c&15])
+	}
+	return strings.ToLower(b.String())
+}
+
+// isUnreserved tells whether the byte is an RFC 3986 unreserved character, which is never percent encoded
+func isUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+// namespaceURI returns the URI of the namespace of a resource, its scheme and host, e.g.
+// amqp://<namespace>.servicebus.windows.net/ for amqp://<namespace>.servicebus.windows.net/<queue>
+func namespaceURI(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Host == "" {
+		return uri
+	}
+	return u.Scheme + "://" + u.Host + "/"
 }
 
 // stringToSign returns the string to sign.
@@ -70,3 +70,80 @@ func TestSASToken(t *testing.T) {
 		t.Error(fmt.Printf("The generated token for the 'Service Bus' '%s' is not the expected one!", serviceBusAuthToken))
 	}
 }
+
+// Tokens for the key fooSasPassword of the policy fooSasUsername, expiring at 300.
+// They were signed with the rule of the Azure Python client, urllib.parse.quote(uri, safe="").lower(), which signatureURI
+// implements too: they catch regressions, they don't prove the rule is the one of the service.
+var signatureVectors = []struct {
+	name  string
+	uri   string
+	sr    string
+	token string
+}{
+	{"Event Hub", "amqp://<NAMESPACE>.servicebus.windows.net/<NAME>",
+		"amqp%3a%2f%2f%3cnamespace%3e.servicebus.windows.net%2f%3cname%3e",
+		"SharedAccessSignature sig=YG4QyqZJTZg4mfgKeWSk8w52nEIksrsjIl8%2BIy2kxrg%3D&se=300&skn=fooSasUsername&sr=amqp%3a%2f%2f%3cnamespace%3e.servicebus.windows.net%2f%3cname%3e"},
+	{"port and query", "https://<NAMESPACE>.servicebus.windows.net:443/<NAME>/head?timeout=60",
+		"https%3a%2f%2f%3cnamespace%3e.servicebus.windows.net%3a443%2f%3cname%3e%2fhead%3ftimeout%3d60",
+		"SharedAccessSignature sig=aBmX7BF9OinPcPOOfs9uqqPddqib76Slag27V8rxooo%3D&se=300&skn=fooSasUsername&sr=https%3a%2f%2f%3cnamespace%3e.servicebus.windows.net%3a443%2f%3cname%3e%2fhead%3ftimeout%3d60"},
+	{"mixed case", "sb://MyNamespace.ServiceBus.Windows.Net/Orders",
+		"sb%3a%2f%2fmynamespace.servicebus.windows.net%2forders",
+		"SharedAccessSignature sig=kFgwGIH09nSW%2BSltrlhdapjVH3LK%2B8hhHHn6Viy42tY%3D&se=300&skn=fooSasUsername&sr=sb%3a%2f%2fmynamespace.servicebus.windows.net%2forders"},
+	{"space", "https://mynamespace.servicebus.windows.net/my queue/messages",
+		"https%3a%2f%2fmynamespace.servicebus.windows.net%2fmy%20queue%2fmessages",
+		"SharedAccessSignature sig=NIKq5%2Bb07d5Jo4Y0fJyrXRGyjXzeszBxfOwbdl8c6vk%3D&se=300&skn=fooSasUsername&sr=https%3a%2f%2fmynamespace.servicebus.windows.net%2fmy%20queue%2fmessages"},
+	{"fragment", "https://mynamespace.servicebus.windows.net/orders/messages?api-version=2017-04#ignored",
+		"https%3a%2f%2fmynamespace.servicebus.windows.net%2forders%2fmessages%3fapi-version%3d2017-04",
+		"SharedAccessSignature sig=zQtGjQJgu7G9RxDpLUPekWqEc9vp78mF5UZt6M1iMxw%3D&se=300&skn=fooSasUsername&sr=https%3a%2f%2fmynamespace.servicebus.windows.net%2forders%2fmessages%3fapi-version%3d2017-04"},
+	{"unicode and unreserved", "amqp://mynamespace.servicebus.windows.net/Ünïcode~._-",
+		"amqp%3a%2f%2fmynamespace.servicebus.windows.net%2f%c3%9cn%c3%afcode~._-",
+		"SharedAccessSignature sig=NWr6jLoW7mDN0ewcU8nDvTVfdlN3vWpnhrjWWqAaIHE%3D&se=300&skn=fooSasUsername&sr=amqp%3a%2f%2fmynamespace.servicebus.windows.net%2f%c3%9cn%c3%afcode~._-"},
+	{"namespace", "https://mynamespace.servicebus.windows.net/",
+		"https%3a%2f%2fmynamespace.servicebus.windows.net%2f",
+		"SharedAccessSignature sig=yyn%2FA0kWDKQ3TUoTezfD%2BryeaM10FlQ9UPKngifodys%3D&se=300&skn=fooSasUsername&sr=https%3a%2f%2fmynamespace.servicebus.windows.net%2f"},
+	{"reserved characters", "https://mynamespace.servicebus.windows.net/a+b!*'()$&,;=@",
+		"https%3a%2f%2fmynamespace.servicebus.windows.net%2fa%2bb%21%2a%27%28%29%24%26%2c%3b%3d%40",
+		"SharedAccessSignature sig=I2LMdPXruPw5kFWkMPHGl8J3ZIhponQfjBkz%2Bt8a7Gc%3D&se=300&skn=fooSasUsername&sr=https%3a%2f%2fmynamespace.servicebus.windows.net%2fa%2bb%21%2a%27%28%29%24%26%2c%3b%3d%40"},
+}
+
+func TestSignatureVectors(t *testing.T) {
+	sasSigner := New("fooNamespace", "fooSasUsername", "fooSasPassword")
+	for _, vector := range signatureVectors {
+		if sr := signatureURI(vector.uri); sr != vector.sr {
+			t.Errorf("%s: the canonical URI is %q, expected %q", vector.name, sr, vector.sr)
+		}
+		if token := sasSigner.Sign(vector.uri, encoded1970ExpiryStr); token != vector.token {
+			t.Errorf("%s: the token is %q, expected %q", vector.name, token, vector.token)
+		}
+	}
+}
+
+// TestSignatureIndependently checks a token against an HMAC computed by openssl, for a URI every Azure client canonicalises
+// the same way, the C# and JavaScript samples included:
+//
+//	printf 'https%%3a%%2f%%2fmynamespace.servicebus.windows.net%%2forders\n1700000000' | openssl dgst -sha256 -hmac fooSasPassword -binary | base64
+func TestSignatureIndependently(t *testing.T) {
+	token := New("fooNamespace", "fooSasUsername", "fooSasPassword").Sign("https://mynamespace.servicebus.windows.net/orders", "1700000000")
+	expected := "SharedAccessSignature sig=eZUpZUbHPKUnU6baRaG61%2F%2BeXajwZ%2Bu1QoLd%2By%2BgtzQ%3D&se=1700000000&skn=fooSasUsername&sr=https%3a%2f%2fmynamespace.servicebus.windows.net%2forders"
+	if token != expected {
+		t.Errorf("The token is %q, expected %q", token, expected)
+	}
+}
+
+func TestSignerScope(t *testing.T) {
+	entityURI := "https://mynamespace.servicebus.windows.net/orders"
+	namespaceToken := New("fooNamespace", "fooSasUsername", "fooSasPassword").Sign("https://mynamespace.servicebus.windows.net/", encoded1970ExpiryStr)
+
+	if token := New("fooNamespace", "fooSasUsername", "fooSasPassword", WithScope(NamespaceScope)).Sign(entityURI, encoded1970ExpiryStr); token != namespaceToken {
+		t.Errorf("The namespace scoped token is %q, expected %q", token, namespaceToken)
+	}
+	if token := New("fooNamespace", "fooSasUsername", "fooSasPassword", WithScope(EntityScope)).Sign(entityURI, encoded1970ExpiryStr); token == namespaceToken {
+		t.Error("The entity scoped token is for the namespace")
+	}
+
+	ring := NewKeyRing(Key{Name: "fooSasUsername", Value: "fooSasPassword"})
+	ring.SetScope(NamespaceScope)
+	if token := ring.Sign(entityURI, encoded1970ExpiryStr); token != namespaceToken {
+		t.Errorf("The namespace scoped key ring token is %q, expected %q", token, namespaceToken)
+	}
+}
@@ -0,0 +1,135 @@
+package msauth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Errors returned when parsing or verifying a token
+var (
+	ErrMalformedToken   = errors.New("msauth: malformed shared access signature")
+	ErrTokenExpired     = errors.New("msauth: shared access signature expired")
+	ErrTokenScope       = errors.New("msauth: shared access signature is not for this resource")
+	ErrInvalidSignature = errors.New("msauth: invalid shared access signature")
+)
+
+const tokenPrefix = "SharedAccessSignature "
+
+// Key is a shared access key along with the name of its policy, the skn of the tokens it signs
+type Key struct {
+	Name  string
+	Value string
+}
+
+// Token is a parsed "SharedAccessSignature sig=...&se=...&skn=...&sr=..." token, as returned by Signer.Sign
+type Token struct {
+	Signature string    // sig, the base64 HMAC-SHA256
+	Expiry    time.Time // se
+	KeyName   string    // skn
+	Resource  string    // sr, the URI the token is for, decoded
+
+	// The signed string is made of the sr and se as they are in the token
+	resource string
+	expiry   string
+}
+
+// ParseToken parses a token into its parts. It doesn't check the signature, use Verify for that.
+func ParseToken(token string) (*Token, error) {
+	token = strings.TrimSpace(token)
+	if !strings.HasPrefix(token, tokenPrefix) {
+		return nil, ErrMalformedToken
+	}
+
+	t := &Token{}
+	for _, field := range strings.Split(strings.TrimPrefix(token, tokenPrefix), "&") {
+		pair := strings.SplitN(field, "=", 2)
+		if len(pair) != 2 {
+			return nil, ErrMalformedToken
+		}
+
+		switch pair[0] {
+		case "sig":
+			signature, err := url.QueryUnescape(pair[1])
+			if err != nil {
+				return nil, ErrMalformedToken
+			}
+			t.Signature = signature
+		case "se":
+			seconds, err := strconv.ParseInt(pair[1], 10, 64)
+			if err != nil {
+				return nil, ErrMalformedToken
+			}
+			t.Expiry = time.Unix(seconds, 0)
+			t.expiry = pair[1]
+		case "skn":
+			t.KeyName = pair[1]
+		case "sr":
+			resource, err := url.QueryUnescape(pair[1])
+			if err != nil {
+				return nil, ErrMalformedToken
+			}
+			t.Resource = resource
+			t.resource = pair[1]
+		}
+	}
+
+	if t.Signature == "" || t.expiry == "" || t.KeyName == "" || t.resource == "" {
+		return nil, ErrMalformedToken
+	}
+	return t, nil
+}
+
+// Verify checks the token is signed by one of the keys with its key name, hasn't expired at now,
+// and is for resourceURI or a parent of it, e.g. a token for a namespace is good for its queues.
+// The schemes of the URIs are ignored, so a token for https://... is good for amqp://...
+// Signatures are compared in constant time.
+func (t *Token) Verify(resourceURI string, now time.Time, keys ...Key) error {
+	signature, err := base64.StdEncoding.DecodeString(t.Signature)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+
+	valid := false
+	for _, key := range keys {
+		if key.Name != t.KeyName {
+			continue
+		}
+		h := hmac.New(sha256.New, []byte(key.Value))
+		h.Write([]byte(stringToSign(t.resource, t.expiry)))
+		if hmac.Equal(h.Sum(nil), signature) {
+			valid = true
+		}
+	}
+	if !valid {
+		return ErrInvalidSignature
+	}
+
+	if !now.Before(t.Expiry) {
+		return ErrTokenExpired
+	}
+	if !t.Covers(resourceURI) {
+		return ErrTokenScope
+	}
+	return nil
+}
+
+// Covers tells whether the token is for resourceURI or a parent of it
+func (t *Token) Covers(resourceURI string) bool {
+	scope, resource := scopeOf(t.Resource), scopeOf(resourceURI)
+	return resource == scope || strings.HasPrefix(resource, scope+"/")
+}
+
+// scopeOf returns the lower case URI without its scheme and trailing slash, as signatureURI lower cases it
+func scopeOf(uri string) string {
+	uri = strings.ToLower(uri)
+	if i := strings.Index(uri, "://"); i >= 0 {
+		uri = uri[i+3:]
+	}
+	return strings.TrimSuffix(uri, "/")
+}
@@ -0,0 +1,78 @@
+package msauth
+
+import (
+	"testing"
+	"time"
+)
+
+const testQueueURI = "https://fooNamespace.servicebus.windows.net/order"
+
+func TestParseToken(t *testing.T) {
+	token, err := ParseToken("SharedAccessSignature sig=8Ew%2B0SNKAp0jAMHLQnYYRlbQBOvwNMu5nP6E3IUySqo%3D&se=300&skn=fooSasUsername&sr=foo%253a%252f%252fbar%253abaz%252furi")
+	if err != nil {
+		t.Fatalf("ParseToken returned %v", err)
+	}
+	if token.Signature != "8Ew+0SNKAp0jAMHLQnYYRlbQBOvwNMu5nP6E3IUySqo=" || token.KeyName != "fooSasUsername" ||
+		token.Resource != encodedFooURI || !token.Expiry.Equal(time.Unix(300, 0)) {
+		t.Errorf("Unexpected token %+v", token)
+	}
+
+	for _, malformed := range []string{
+		"",
+		"sig=abc&se=300&skn=foo&sr=bar",
+		"SharedAccessSignature sig=abc&se=soon&skn=foo&sr=bar",
+		"SharedAccessSignature sig=abc&se=300&skn=foo",
+		"SharedAccessSignature sig=abc&se=300&sr=bar",
+		"SharedAccessSignature sig=abc&se=300&skn=foo&sr=bar&garbage",
+	} {
+		if _, err := ParseToken(malformed); err != ErrMalformedToken {
+			t.Errorf("Parsing %q returned %v, expected %v", malformed, err, ErrMalformedToken)
+		}
+	}
+}
+
+func TestVerifyToken(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	key := Key{Name: "fooSasUsername", Value: "fooSasPassword"}
+	signed := New("fooNamespace", key.Name, key.Value).Sign(testQueueURI, SignatureExpiry(now, time.Hour))
+
+	token, err := ParseToken(signed)
+	if err != nil {
+		t.Fatalf("ParseToken returned %v", err)
+	}
+
+	for name, test := range map[string]struct {
+		uri  string
+		now  time.Time
+		keys []Key
+		err  error
+	}{
+		"valid":             {testQueueURI, now, []Key{key}, nil},
+		"other scheme":      {"amqp://fooNamespace.servicebus.windows.net/order/", now, []Key{key}, nil},
+		"child resource":    {testQueueURI + "/messages", now, []Key{key}, nil},
+		"second key":        {testQueueURI, now, []Key{{Name: key.Name, Value: "old"}, key}, nil},
+		"expired":           {testQueueURI, now.Add(time.Hour), []Key{key}, ErrTokenExpired},
+		"other resource":    {"https://fooNamespace.servicebus.windows.net/orders", now, []Key{key}, ErrTokenScope},
+		"parent resource":   {"https://fooNamespace.servicebus.windows.net/", now, []Key{key}, ErrTokenScope},
+		"wrong key":         {testQueueURI, now, []Key{{Name: key.Name, Value: "wrong"}}, ErrInvalidSignature},
+		"key of other name": {testQueueURI, now, []Key{{Name: "other", Value: key.Value}}, ErrInvalidSignature},
+		"no keys":           {testQueueURI, now, nil, ErrInvalidSignature},
+	} {
+		if err := token.Verify(test.uri, test.now, test.keys...); err != test.err {
+			t.Errorf("%s: Verify returned %v, expected %v", name, err, test.err)
+		}
+	}
+}
+
+func TestVerifyTamperedToken(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	key := Key{Name: "fooSasUsername", Value: "fooSasPassword"}
+	token, _ := ParseToken(New("fooNamespace", key.Name, key.Value).Sign(testQueueURI, SignatureExpiry(now, time.Hour)))
+
+	// Pushing the expiry back breaks the signature
+	token.expiry = SignatureExpiry(now, 24*time.Hour)
+	token.Expiry = now.Add(24 * time.Hour)
+	if err := token.Verify(testQueueURI, now, key); err != ErrInvalidSignature {
+		t.Errorf("Verify returned %v for a tampered token, expected %v", err, ErrInvalidSignature)
+	}
+}
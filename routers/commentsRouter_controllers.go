@@ -7,6 +7,14 @@ import (
 
 func init() {
 
+	beego.GlobalControllerRouter["captureorderfd/controllers:AdminController"] = append(beego.GlobalControllerRouter["captureorderfd/controllers:AdminController"],
+		beego.ControllerComments{
+			Method:           "Outbox",
+			Router:           `/outbox`,
+			AllowHTTPMethods: []string{"get"},
+			MethodParams:     param.Make(),
+			Params:           nil})
+
 	beego.GlobalControllerRouter["captureorderfd/controllers:OrderController"] = append(beego.GlobalControllerRouter["captureorderfd/controllers:OrderController"],
 		beego.ControllerComments{
 			Method:           "Post",
@@ -14,4 +22,28 @@ func init() {
 			AllowHTTPMethods: []string{"post"},
 			MethodParams:     param.Make(),
 			Params:           nil})
+
+	beego.GlobalControllerRouter["captureorderfd/controllers:OrderController"] = append(beego.GlobalControllerRouter["captureorderfd/controllers:OrderController"],
+		beego.ControllerComments{
+			Method:           "Get",
+			Router:           `/:orderId`,
+			AllowHTTPMethods: []string{"get"},
+			MethodParams:     param.Make(),
+			Params:           nil})
+
+	beego.GlobalControllerRouter["captureorderfd/controllers:OrderController"] = append(beego.GlobalControllerRouter["captureorderfd/controllers:OrderController"],
+		beego.ControllerComments{
+			Method:           "GetAll",
+			Router:           `/`,
+			AllowHTTPMethods: []string{"get"},
+			MethodParams:     param.Make(),
+			Params:           nil})
+
+	beego.GlobalControllerRouter["captureorderfd/controllers:OrderController"] = append(beego.GlobalControllerRouter["captureorderfd/controllers:OrderController"],
+		beego.ControllerComments{
+			Method:           "UpdateStatus",
+			Router:           `/:orderId/status`,
+			AllowHTTPMethods: []string{"put", "patch"},
+			MethodParams:     param.Make(),
+			Params:           nil})
 }
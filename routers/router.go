@@ -9,6 +9,8 @@ package routers
 
 import (
 	"captureorderfd/controllers"
+	"captureorderfd/logging"
+	"captureorderfd/models"
 
 	"github.com/astaxie/beego/context"
 	"github.com/astaxie/beego/plugins/cors"
@@ -23,15 +25,55 @@ func init() {
 				&controllers.OrderController{},
 			),
 		),
+		beego.NSNamespace("/admin",
+			beego.NSInclude(
+				&controllers.AdminController{},
+			),
+		),
 	)
 	beego.AddNamespace(ns)
 	beego.Get("/healthz", func(ctx *context.Context) {
-		ctx.Output.Body([]byte("i'm alive!"))
+		// Stay alive while the broker is away, events wait in the outbox until it is back
+		ctx.Output.JSON(map[string]string{
+			"status": "i'm alive!",
+			"amqp":   models.PublisherState(),
+		}, false, false)
 	})
+	beego.Handler("/metrics", models.MetricsHandler())
+	beego.InsertFilter("*", beego.BeforeRouter, requestID)
 	beego.InsertFilter("*", beego.BeforeRouter, cors.Allow(&cors.Options{
 		AllowAllOrigins: true,
-		AllowMethods:    []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders:    []string{"Origin", "Authorization", "Access-Control-Allow-Origin"},
-		ExposeHeaders:   []string{"Content-Length", "Access-Control-Allow-Origin"},
+		AllowMethods:    []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowHeaders:    []string{"Origin", "Authorization", "Access-Control-Allow-Origin", "Idempotency-Key", "X-Correlation-ID", logging.RequestIDHeader, "traceparent", "tracestate"},
+		ExposeHeaders:   []string{"Content-Length", "Access-Control-Allow-Origin", "Idempotent-Replayed", logging.RequestIDHeader},
 	}))
+	beego.InsertFilter("/v1/admin/*", beego.BeforeRouter, authorizeAdmin)
+}
+
+// requestID takes the X-Request-ID of the request, or assigns a new one if it is missing or malformed,
+// returns it in the response and puts it in the context of the request for the logs, telemetry and events
+func requestID(ctx *context.Context) {
+	id := ctx.Input.Header(logging.RequestIDHeader)
+	if !logging.ValidRequestID(id) {
+		id = logging.NewRequestID()
+	}
+	ctx.Output.Header(logging.RequestIDHeader, id)
+	ctx.Request = ctx.Request.WithContext(logging.WithRequestID(ctx.Request.Context(), id))
+}
+
+// authorizeAdmin serves a 401, or a 403 while the admin API is disabled, unless the request has a valid admin token
+func authorizeAdmin(ctx *context.Context) {
+	err := models.AuthorizeAdmin(ctx.Input.Header("Authorization"), ctx.Request.Host+ctx.Request.URL.Path)
+	if err == nil {
+		return
+	}
+
+	logging.FromContext(ctx.Request.Context()).Warn("Refused an admin request", "path", ctx.Request.URL.Path, "error", err)
+	if err == models.ErrAdminDisabled {
+		ctx.Output.SetStatus(403)
+	} else {
+		ctx.Output.Header("WWW-Authenticate", "SharedAccessSignature")
+		ctx.Output.SetStatus(401)
+	}
+	ctx.Output.JSON(map[string]string{"error": err.Error()}, false, false)
 }